@@ -0,0 +1,369 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"sort"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gopkg.in/src-d/go-git.v4"
+	gitobj "gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+var commands = map[string]func(args []string) int{
+	"serve":    serveCommand,
+	"sync":     syncCommand,
+	"plan":     planCommand,
+	"validate": validateCommand,
+	"export":   exportCommand,
+	"rollback": rollbackCommand,
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, `Usage: git2etcd [command] [flags]
+
+Commands:
+  serve     Sync periodically and on webhooks, the default
+  sync      Sync once and exit
+  plan      Print what a sync would change and exit
+  validate  Check the files of the repo can be synced
+  export    Dump an etcd subtree to a directory
+  rollback  Apply an older commit and pin etcd to it
+
+Run git2etcd <command> -h for the flags of a command.`)
+}
+
+// newFlagSet returns the flags of command, along with the config directory
+// flag they all share.
+func newFlagSet(command string) (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	confDir := flags.String("conf_dir", "", "Path to look for a config file. (directory)")
+	return flags, confDir
+}
+
+func loadConfig(confDir string) {
+	setConfig(confDir)
+	if err := loadRepos(); err != nil {
+		log.WithError(err).Fatal("Couldn't configure repos")
+	}
+	if err := loadParseRules(); err != nil {
+		log.WithError(err).Fatal("Couldn't configure file parsing")
+	}
+	if err := loadMappingRules(); err != nil {
+		log.WithError(err).Fatal("Couldn't configure key mapping")
+	}
+	if err := loadDriftPolicies(); err != nil {
+		log.WithError(err).Fatal("Couldn't configure drift policies")
+	}
+}
+
+// connect opens the store and the repositories.
+func connect() {
+	// etcd Client connection
+	if err := storeConnect(); err != nil {
+		log.WithError(err).Fatal("Couldn't connect to etcd")
+	}
+
+	// Git repositories opening/cloning
+	for _, repo := range repos {
+		if err := openOrCloneRepo(repo); err != nil {
+			log.WithError(err).WithField("repo", repo.Name).Fatal("Couldn't find repo or clone it")
+		}
+		if err := loadSyncState(repo); err != nil {
+			log.WithError(err).WithField("repo", repo.Name).Warn("Couldn't read the sync state")
+		}
+		repo.commits = commitsOf(repo)
+	}
+}
+
+func serveCommand(args []string) int {
+	flags, confDir := newFlagSet("serve")
+	flags.Parse(args)
+	loadConfig(*confDir)
+	connect()
+	if viper.GetBool("leader.enabled") {
+		go electionLoop()
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-signals
+			releaseLeadership()
+			os.Exit(0)
+		}()
+	}
+	for _, repo := range repos {
+		startWorker(repo)
+		enqueueJob(repo, jobAuto, "", "start")
+
+		go func(repo *syncedRepo) {
+			syncCycle := time.Duration(repo.SyncCycle) * time.Second
+			if syncCycle > 0 {
+				for {
+					select {
+					case <-time.After(syncCycle):
+						enqueueJob(repo, jobAuto, "", "cycle")
+					}
+				}
+			} else {
+				log.WithField("repo", repo.Name).Info("No sync cycle")
+			}
+		}(repo)
+
+		if driftInterval := time.Duration(viper.GetInt("drift.interval")) * time.Second; driftInterval > 0 {
+			go driftLoop(repo, driftInterval)
+		}
+		if viper.GetBool("watch.enabled") {
+			go watchLoop(repo)
+		}
+	}
+
+	// HTTP serving
+	hooks, err := webhookConfigs()
+	if err != nil {
+		log.WithError(err).Fatal("Couldn't configure webhooks")
+	}
+	for _, hook := range hooks {
+		log.WithFields(log.Fields{
+			"path":     "/" + hook.Path,
+			"provider": hook.Provider,
+			"repo":     hook.repo.Name,
+		}).Info("Serving webhook")
+		http.HandleFunc("/"+hook.Path, leaderOnly(hookHandler(hook)))
+	}
+	http.HandleFunc("/sync", leaderOnly(syncHandler))
+	http.HandleFunc("/rollback", leaderOnly(rollbackHandler))
+	http.HandleFunc("/metrics", metricsHandler)
+	http.HandleFunc("/jobs", leaderOnly(jobHandler))
+	http.HandleFunc("/jobs/", leaderOnly(jobHandler))
+	http.HandleFunc("/plan", planHandler)
+	http.HandleFunc("/drift", driftHandler)
+	http.HandleFunc("/status", statusHandler)
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/readyz", readyzHandler)
+	log.Fatal(http.ListenAndServe(viper.GetString("host.listen")+":"+viper.GetString("host.port"), nil))
+	return 1
+}
+
+func syncCommand(args []string) int {
+	flags, confDir := newFlagSet("sync")
+	name := flags.String("repo", "", "Repo to sync, all of them if empty.")
+	full := flags.Bool("full", false, "Write the whole tree, and prune if enabled, even if the head is already applied.")
+	flags.Parse(args)
+	loadConfig(*confDir)
+	selected := repos
+	if *name != "" {
+		repo, err := findRepo(*name)
+		if err != nil {
+			log.WithError(err).Error("Couldn't find repo")
+			return 2
+		}
+		selected = []*syncedRepo{repo}
+	}
+	connect()
+	status := 0
+	for _, repo := range selected {
+		if err := syncRepo(repo, *full); err != nil {
+			log.WithError(err).WithField("repo", repo.Name).Error("Couldn't sync repo")
+			status = 1
+		}
+	}
+	return status
+}
+
+func planCommand(args []string) int {
+	flags, confDir := newFlagSet("plan")
+	format := flags.String("format", "text", "Format of the plan, text or json.")
+	name := flags.String("repo", "", "Repo to plan, may be empty when there's only one.")
+	flags.Parse(args)
+	loadConfig(*confDir)
+	repo, err := findRepo(*name)
+	if err != nil {
+		log.WithError(err).Error("Couldn't find repo")
+		return 2
+	}
+	connect()
+	plan, err := planRepo(repo)
+	if err != nil {
+		log.WithError(err).Error("Couldn't plan sync")
+		return 1
+	}
+	if err := plan.write(os.Stdout, *format); err != nil {
+		log.WithError(err).Error("Couldn't print plan")
+		return 1
+	}
+	return 0
+}
+
+func validateCommand(args []string) int {
+	flags, confDir := newFlagSet("validate")
+	repoPath := flags.String("path", "", "Path of the repo to check, the clone of -repo if empty.")
+	name := flags.String("repo", "", "Repo whose config to check with, may be empty when there's only one.")
+	flags.Parse(args)
+	loadConfig(*confDir)
+	repo, err := findRepo(*name)
+	if err != nil {
+		log.WithError(err).Error("Couldn't find repo")
+		return 2
+	}
+	if *repoPath == "" {
+		*repoPath = repo.Path
+	}
+	gitRepo, err := git.PlainOpen(*repoPath)
+	if err != nil {
+		log.WithError(err).Error("Couldn't open repo")
+		return 1
+	}
+	problems, err := validateRepo(repo, gitRepo)
+	if err != nil {
+		log.WithError(err).Error("Couldn't validate repo")
+		return 1
+	}
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// validateRepo returns the problems preventing the head of gitRepo from being
+// synced by repo: files that can't be read or parsed, and keys that several
+// files would be stored at.
+func validateRepo(repo *syncedRepo, gitRepo *git.Repository) ([]string, error) {
+	head, err := gitRepo.Head()
+	if err != nil {
+		return nil, errors.New("Couldn't get head: " + err.Error())
+	}
+	commit, err := gitRepo.CommitObject(head.Hash())
+	if err != nil {
+		return nil, errors.New("Couldn't get commit: " + err.Error())
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, errors.New("Couldn't get commit tree: " + err.Error())
+	}
+	synced, _, err := syncedFiles(repo, tree)
+	if err != nil {
+		return nil, err
+	}
+	problems := []string{}
+	files := map[string]string{}
+	for _, f := range synced {
+		kvs, err := gitFileKeys(repo.Prefix, f.Path, f.File)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		for key := range kvs {
+			if other, ok := files[key]; ok {
+				problems = append(problems, fmt.Sprintf("Key %s comes from both %s and %s", key, other, f.Name))
+				continue
+			}
+			if underPrefix(key, stateDir()) {
+				problems = append(problems, fmt.Sprintf("Key %s of %s is in the state directory", key, f.Name))
+			}
+			files[key] = f.Name
+		}
+	}
+	if viper.GetString("etcd.api") == "v2" {
+		// The v2 API can't hold a value and children at the same key
+		for key, file := range files {
+			for dir := path.Dir(key); dir != "/"; dir = path.Dir(dir) {
+				if other, ok := files[dir]; ok {
+					problems = append(problems, fmt.Sprintf("Key %s of %s is below key %s of %s", key, file, dir, other))
+				}
+			}
+		}
+	}
+	sort.Strings(problems)
+	return problems, nil
+}
+
+func exportCommand(args []string) int {
+	flags, confDir := newFlagSet("export")
+	prefix := flags.String("prefix", "", "etcd subtree to export, the prefix of -repo if empty.")
+	name := flags.String("repo", "", "Repo whose key mapping to export with, may be empty when there's only one.")
+	dir := flags.String("dir", "", "Directory to write the files to.")
+	commit := flags.Bool("commit", false, "Commit the files to a new branch of the repo in -dir, creating it if needed.")
+	branch := flags.String("branch", "git2etcd-export", "Branch to commit the files to.")
+	authorName := flags.String("author_name", "git2etcd", "Name of the commit author.")
+	authorEmail := flags.String("author_email", "git2etcd@localhost", "Email of the commit author.")
+	flags.Parse(args)
+	if *dir == "" {
+		fmt.Fprintln(os.Stderr, "Missing -dir")
+		flags.Usage()
+		return 2
+	}
+	loadConfig(*confDir)
+	repo, err := findRepo(*name)
+	if err != nil {
+		log.WithError(err).Error("Couldn't find repo")
+		return 2
+	}
+	if *prefix == "" {
+		*prefix = repo.Prefix
+	}
+	if err := storeConnect(); err != nil {
+		log.WithError(err).Error("Couldn't connect to etcd")
+		return 1
+	}
+	var exportRepo *git.Repository
+	if *commit {
+		if exportRepo, err = exportBranch(*dir, *branch); err != nil {
+			log.WithError(err).Error("Couldn't prepare export branch")
+			return 1
+		}
+	}
+	files, err := exportKeys(repo, *prefix, *dir)
+	if err != nil {
+		log.WithError(err).Error("Couldn't export keys")
+		return 1
+	}
+	log.WithField("files", len(files)).Info("Keys exported")
+	if *commit {
+		author := &gitobj.Signature{Name: *authorName, Email: *authorEmail, When: time.Now()}
+		hash, err := commitExport(exportRepo, files, "Export etcd keys under "+*prefix, author)
+		if err != nil {
+			log.WithError(err).Error("Couldn't commit exported files")
+			return 1
+		}
+		log.WithFields(log.Fields{
+			"branch": *branch,
+			"commit": hash.String(),
+		}).Info("Exported files committed")
+	}
+	return 0
+}
+
+func rollbackCommand(args []string) int {
+	flags, confDir := newFlagSet("rollback")
+	commit := flags.String("commit", "", "Commit to roll back to, as a hash or any revision.")
+	name := flags.String("repo", "", "Repo to roll back, may be empty when there's only one.")
+	flags.Parse(args)
+	if *commit == "" {
+		fmt.Fprintln(os.Stderr, "Missing -commit")
+		flags.Usage()
+		return 2
+	}
+	loadConfig(*confDir)
+	repo, err := findRepo(*name)
+	if err != nil {
+		log.WithError(err).Error("Couldn't find repo")
+		return 2
+	}
+	connect()
+	if err := rollbackRepo(repo, *commit); err != nil {
+		log.WithError(err).Error("Couldn't roll back")
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	driftReport = "report"
+	driftRevert = "revert"
+	driftIgnore = "ignore"
+)
+
+// driftPolicyRule sets the policy of the keys under Prefix.
+type driftPolicyRule struct {
+	Prefix string
+	Policy string
+}
+
+var driftPolicies []driftPolicyRule
+
+func loadDriftPolicies() error {
+	rules := []driftPolicyRule{}
+	if err := viper.UnmarshalKey("drift.policies", &rules); err != nil {
+		return errors.New("Couldn't read drift policies: " + err.Error())
+	}
+	rules = append(rules, driftPolicyRule{Prefix: "/", Policy: viper.GetString("drift.policy")})
+	for i, rule := range rules {
+		switch rule.Policy {
+		case driftReport, driftRevert, driftIgnore:
+		default:
+			return errors.New("Unknown drift policy " + rule.Policy)
+		}
+		rules[i].Prefix = "/" + strings.Trim(rule.Prefix, "/")
+	}
+	driftPolicies = rules
+	return nil
+}
+
+// driftPolicy returns the policy of the longest prefix key is under.
+func driftPolicy(key string) string {
+	policy, length := driftReport, -1
+	for _, rule := range driftPolicies {
+		if underPrefix(key, rule.Prefix) && len(rule.Prefix) > length {
+			policy, length = rule.Policy, len(rule.Prefix)
+		}
+	}
+	return policy
+}
+
+// drift is a managed key whose value in the store isn't the one in git.
+type drift struct {
+	Key string `json:"key"`
+	// Kind is changed, missing, or extra for keys without a file when pruning
+	Kind string `json:"kind"`
+	File string `json:"file,omitempty"`
+	// Layer is the overlay layer the expected value comes from
+	Layer    string `json:"layer,omitempty"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+	Policy   string `json:"policy"`
+}
+
+type driftCheck struct {
+	Repo    string    `json:"repo"`
+	Commit  string    `json:"commit"`
+	Checked time.Time `json:"checked"`
+	Drifts  []drift   `json:"drifts"`
+}
+
+// checkDrift compares every managed key with the applied commit, leaving out
+// the keys whose policy is to ignore drifts.
+func checkDrift(repo *syncedRepo) (*driftCheck, error) {
+	if err := recordedState(repo); err != nil {
+		return nil, err
+	}
+	tree, hash, err := appliedTree(repo)
+	if err != nil {
+		return nil, err
+	}
+	state, err := treeKeys(repo, tree)
+	if err != nil {
+		return nil, err
+	}
+	current, err := store.List(repo.Prefix)
+	if err != nil {
+		return nil, errors.New("Couldn't list current keys: " + err.Error())
+	}
+	check := &driftCheck{Repo: repo.Name, Commit: hash.String(), Checked: time.Now(), Drifts: []drift{}}
+	add := func(d drift) {
+		if d.Policy = driftPolicy(d.Key); d.Policy != driftIgnore {
+			check.Drifts = append(check.Drifts, d)
+		}
+	}
+	for _, key := range sortedKeys(state.kvs) {
+		expected := state.kvs[key]
+		actual, ok := current[key]
+		if !ok {
+			add(drift{Key: key, Kind: "missing", File: state.files[key], Layer: state.layers[key], Expected: expected})
+		} else if actual != expected {
+			add(drift{Key: key, Kind: "changed", File: state.files[key], Layer: state.layers[key], Expected: expected, Actual: actual})
+		}
+	}
+	if viper.GetBool("repo.prune") {
+		for _, key := range sortedKeys(current) {
+			if _, ok := state.kvs[key]; ok || !underPrefix(key, repo.Prefix) || underPrefix(key, stateDir()) {
+				continue
+			}
+			add(drift{Key: key, Kind: "extra", Actual: current[key]})
+		}
+	}
+	return check, nil
+}
+
+// enforceDrift logs the drifts of check, and reverts the ones whose policy
+// asks for it.
+func enforceDrift(repo *syncedRepo, check *driftCheck) error {
+	ops := []storeOp{}
+	for _, d := range check.Drifts {
+		log.WithFields(log.Fields{
+			"repo":   check.Repo,
+			"key":    d.Key,
+			"kind":   d.Kind,
+			"file":   d.File,
+			"layer":  d.Layer,
+			"policy": d.Policy,
+		}).Warn("Key drifted from git")
+		if d.Policy != driftRevert {
+			continue
+		}
+		if d.Kind == "extra" {
+			ops = append(ops, storeOp{Type: opDelete, Key: d.Key})
+		} else {
+			ops = append(ops, storeOp{Type: opSet, Key: d.Key, Value: d.Expected})
+		}
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+	log.WithField("keys", len(ops)).Info("Reverting drifted keys")
+	return writeOps(repo, ops)
+}
+
+func driftLoop(repo *syncedRepo, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if isLeader() {
+			revertDrift(repo)
+		}
+	}
+}
+
+// revertDrift checks and enforces the drifts of repo, holding its lock so
+// that a sync can't write the next commit meanwhile.
+func revertDrift(repo *syncedRepo) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	check, err := checkDrift(repo)
+	if err != nil {
+		log.WithError(err).Warn("Couldn't check drift")
+		return
+	}
+	if err := enforceDrift(repo, check); err != nil {
+		log.WithError(err).Warn("Couldn't revert drifted keys")
+	}
+}
+
+func driftHandler(w http.ResponseWriter, r *http.Request) {
+	repo, ok := requestRepo(w, r)
+	if !ok {
+		return
+	}
+	repo.lock.Lock()
+	check, err := checkDrift(repo)
+	repo.lock.Unlock()
+	if err != nil {
+		http.Error(w, "Couldn't check drift: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(check)
+}
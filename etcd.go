@@ -2,92 +2,154 @@ package main
 
 import (
 	"errors"
-	"io/ioutil"
-	"os"
-	"strings"
+	"net/http"
 	"time"
 
 	"golang.org/x/net/context"
 
 	etcd "github.com/coreos/etcd/client"
-	"github.com/spf13/viper"
 )
 
-func etcdConnect() error {
-	hosts := []string{}
-	if viper.IsSet("etcd.host") {
-		hosts = []string{viper.GetString("etcd.host")}
-	} else {
-		hosts = viper.GetStringSlice("etcd.hosts")
-	}
+// etcdV2Store stores keys through the etcd v2 keys API.
+type etcdV2Store struct {
+	kapi etcd.KeysAPI
+}
+
+func newEtcdV2Store(hosts []string, transport *http.Transport, username, password string) (*etcdV2Store, error) {
 	cfg := etcd.Config{
 		Endpoints:               hosts,
-		Transport:               etcd.DefaultTransport,
+		Transport:               transport,
+		Username:                username,
+		Password:                password,
 		HeaderTimeoutPerRequest: time.Second,
 	}
 	cli, err := etcd.New(cfg)
 	if err != nil {
-		return err
-	}
-	etcdClient = etcd.NewKeysAPI(cli)
-	_, err = etcdClient.Get(context.Background(), "/foo", nil)
-	if err != nil && err.Error() == etcd.ErrClusterUnavailable.Error() {
-		return err
+		return nil, err
 	}
-	return nil
+	return &etcdV2Store{kapi: etcd.NewKeysAPI(cli)}, nil
 }
 
-func etcdCreate(file string) error {
-	fd, err := os.Open(viper.GetString("repo.path") + _sep + file)
+func (s *etcdV2Store) Get(key string) (val string, ok bool, err error) {
+	defer observeEtcd("get", time.Now(), &err)
+	resp, err := s.kapi.Get(context.Background(), key, nil)
 	if err != nil {
-		return errors.New("Couldn't open file " + file + " : " + err.Error())
+		if etcd.IsKeyNotFound(err) {
+			return "", false, nil
+		}
+		return "", false, errors.New("Couldn't get key " + key + " : " + err.Error())
 	}
-	val, err := ioutil.ReadAll(fd)
+	return resp.Node.Value, true, nil
+}
+
+func (s *etcdV2Store) List(dir string) (kvs map[string]string, err error) {
+	defer observeEtcd("list", time.Now(), &err)
+	resp, err := s.kapi.Get(context.Background(), dir, &etcd.GetOptions{Recursive: true})
 	if err != nil {
-		return errors.New("Couldn't read file " + file + " : " + err.Error())
+		if etcd.IsKeyNotFound(err) {
+			return map[string]string{}, nil
+		}
+		return nil, errors.New("Couldn't list " + dir + " : " + err.Error())
+	}
+	kvs = map[string]string{}
+	var walk func(node *etcd.Node)
+	walk = func(node *etcd.Node) {
+		if !node.Dir {
+			kvs[node.Key] = node.Value
+			return
+		}
+		for _, child := range node.Nodes {
+			walk(child)
+		}
 	}
-	// TrimSpace is used mostly to remove trailing newlines from Git files
-	_, err = etcdClient.Create(context.Background(), file, strings.TrimSpace(string(val)))
+	walk(resp.Node)
+	return kvs, nil
+}
+
+func (s *etcdV2Store) Create(key, val string) (err error) {
+	defer observeEtcd("create", time.Now(), &err)
+	_, err = s.kapi.Create(context.Background(), key, val)
 	if err != nil {
-		return errors.New("Couldn't create file " + file + " : " + err.Error())
+		return errors.New("Couldn't create key " + key + " : " + err.Error())
 	}
 	return nil
 }
 
-func etcdSet(file string) error {
-	fd, err := os.Open(viper.GetString("repo.path") + _sep + file)
+func (s *etcdV2Store) Set(key, val string) (err error) {
+	defer observeEtcd("set", time.Now(), &err)
+	_, err = s.kapi.Set(context.Background(), key, val, nil)
 	if err != nil {
-		return errors.New("Couldn't open file " + file + " : " + err.Error())
+		return errors.New("Couldn't set key " + key + " : " + err.Error())
 	}
-	val, err := ioutil.ReadAll(fd)
-	if err != nil {
-		return errors.New("Couldn't read file " + file + " : " + err.Error())
+	return nil
+}
+
+func (s *etcdV2Store) Delete(key string) (err error) {
+	defer observeEtcd("delete", time.Now(), &err)
+	_, err = s.kapi.Delete(context.Background(), key, nil)
+	if err != nil && !etcd.IsKeyNotFound(err) {
+		return errors.New("Couldn't delete key " + key + " : " + err.Error())
 	}
-	// TrimSpace is used mostly to remove trailing newlines from Git files
-	_, err = etcdClient.Set(context.Background(), file, strings.TrimSpace(string(val)), nil)
-	if err != nil {
-		return errors.New("Couldn't set file " + file + " : " + err.Error())
+	return nil
+}
+
+func (s *etcdV2Store) Check() (err error) {
+	defer observeEtcd("check", time.Now(), &err)
+	_, err = s.kapi.Get(context.Background(), "/", nil)
+	if err != nil && !etcd.IsKeyNotFound(err) {
+		return errors.New("Couldn't reach etcd : " + err.Error())
 	}
 	return nil
 }
 
-func etcdDelete(file string) error {
-	_, err := os.Stat(viper.GetString("repo.path") + _sep + file)
-	if err != nil && os.IsNotExist(err) {
-		_, err = etcdClient.Delete(context.Background(), file, nil)
+func (s *etcdV2Store) Watch(dir string, fn func(storeEvent)) error {
+	watcher := s.kapi.Watcher(dir, &etcd.WatcherOptions{Recursive: true})
+	for {
+		resp, err := watcher.Next(context.Background())
 		if err != nil {
-			return errors.New("Couldn't set file " + file + " : " + err.Error())
+			return errors.New("Couldn't watch " + dir + " : " + err.Error())
+		}
+		if resp.Node == nil || resp.Node.Dir {
+			continue
+		}
+		event := storeEvent{Key: resp.Node.Key, Value: resp.Node.Value, Revision: resp.Node.ModifiedIndex}
+		switch resp.Action {
+		case "delete", "expire", "compareAndDelete":
+			event.Deleted = true
 		}
-	} else {
-		return errors.New("File still exsits, not deleting " + file + " : " + err.Error())
+		fn(event)
 	}
-	return nil
 }
 
-func etcdExists(file string) bool {
-	_, err := etcdClient.Get(context.Background(), file, nil)
-	if err != nil && strings.Contains(err.Error(), "Key not found") {
-		return false
+func (s *etcdV2Store) Acquire(key, val string, ttl time.Duration) (ok bool, err error) {
+	defer observeEtcd("acquire", time.Now(), &err)
+	_, err = s.kapi.Set(context.Background(), key, val, &etcd.SetOptions{TTL: ttl, PrevExist: etcd.PrevNoExist})
+	if err == nil {
+		return true, nil
+	}
+	if e, ok := err.(etcd.Error); !ok || e.Code != etcd.ErrorCodeNodeExist {
+		return false, errors.New("Couldn't acquire key " + key + " : " + err.Error())
+	}
+	// Refresh the key if it's still ours
+	_, err = s.kapi.Set(context.Background(), key, val, &etcd.SetOptions{TTL: ttl, PrevValue: val, PrevExist: etcd.PrevExist})
+	if err == nil {
+		return true, nil
+	}
+	if e, ok := err.(etcd.Error); ok && (e.Code == etcd.ErrorCodeTestFailed || e.Code == etcd.ErrorCodeKeyNotFound) {
+		return false, nil
+	}
+	return false, errors.New("Couldn't refresh key " + key + " : " + err.Error())
+}
+
+func (s *etcdV2Store) Release(key, val string) (err error) {
+	defer observeEtcd("release", time.Now(), &err)
+	_, err = s.kapi.Delete(context.Background(), key, &etcd.DeleteOptions{PrevValue: val})
+	if err == nil || etcd.IsKeyNotFound(err) {
+		return nil
+	}
+	if e, ok := err.(etcd.Error); ok && e.Code == etcd.ErrorCodeTestFailed {
+		// Someone else holds it already
+		return nil
 	}
-	return true
+	return errors.New("Couldn't release key " + key + " : " + err.Error())
 }
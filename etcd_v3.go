@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-semver/semver"
+)
+
+// etcdV3Store stores keys through the JSON gateway of the etcd v3 API
+// (/v3 since etcd 3.4, /v3beta on etcd 3.3), which spares vendoring the gRPC
+// client and its dependencies.
+type etcdV3Store struct {
+	endpoints []string
+	username  string
+	password  string
+	maxOps    int
+	client    *http.Client
+	// watcher has no timeout, watches lasting as long as they can
+	watcher *http.Client
+	// lock guards the gateway, found on the first call unless configured,
+	// and the auth token
+	lock    sync.Mutex
+	gateway string
+	token   string
+	// leaseLock is held through Acquire and Release, which the election loop
+	// and the signal handler may run together, and guards lease, the ID of the
+	// lease of the key held. It's apart from lock, taken by each call.
+	leaseLock sync.Mutex
+	lease     string
+}
+
+type etcdV3KeyValue struct {
+	Key            string `json:"key"`
+	Value          string `json:"value"`
+	CreateRevision string `json:"create_revision"`
+	ModRevision    string `json:"mod_revision"`
+}
+
+type etcdV3Header struct {
+	Revision string `json:"revision"`
+}
+
+type etcdV3RangeResponse struct {
+	Header etcdV3Header      `json:"header"`
+	Kvs    []*etcdV3KeyValue `json:"kvs"`
+}
+
+func newEtcdV3Store(hosts []string, transport *http.Transport, username, password, gateway string, maxOps int) (*etcdV3Store, error) {
+	if len(hosts) == 0 {
+		return nil, errors.New("No etcd endpoint")
+	}
+	if maxOps < 2 {
+		return nil, errors.New("etcd.v3.maxtxnops must be at least 2")
+	}
+	endpoints := []string{}
+	for _, host := range hosts {
+		endpoints = append(endpoints, strings.TrimSuffix(host, "/"))
+	}
+	if gateway != "" {
+		gateway = "/" + strings.Trim(gateway, "/")
+	}
+	return &etcdV3Store{
+		endpoints: endpoints,
+		username:  username,
+		password:  password,
+		gateway:   gateway,
+		maxOps:    maxOps,
+		client:    &http.Client{Transport: transport, Timeout: 5 * time.Second},
+		watcher:   &http.Client{Transport: transport},
+	}, nil
+}
+
+// v3Gateway returns the path of the gateway, picked from the version of etcd
+// the first time unless etcd.v3.gateway sets it.
+func (s *etcdV3Store) v3Gateway(endpoint string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.gateway != "" {
+		return s.gateway, nil
+	}
+	r, err := s.client.Get(endpoint + "/version")
+	if err != nil {
+		return "", err
+	}
+	defer r.Body.Close()
+	var version struct {
+		Server string `json:"etcdserver"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&version); err != nil {
+		return "", errors.New("Couldn't read etcd version : " + err.Error())
+	}
+	v, err := semver.NewVersion(version.Server)
+	if err != nil {
+		return "", errors.New("Couldn't read etcd version : " + err.Error())
+	}
+	switch {
+	case v.LessThan(semver.Version{Major: 3, Minor: 3}):
+		s.gateway = "/v3alpha"
+	case v.LessThan(semver.Version{Major: 3, Minor: 4}):
+		s.gateway = "/v3beta"
+	default:
+		s.gateway = "/v3"
+	}
+	return s.gateway, nil
+}
+
+// authToken returns the token of the calls, authenticating the first time
+// when etcd.username is set.
+func (s *etcdV3Store) authToken(endpoint, gateway string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.username == "" || s.token != "" {
+		return s.token, nil
+	}
+	body, err := json.Marshal(map[string]string{"name": s.username, "password": s.password})
+	if err != nil {
+		return "", err
+	}
+	r, err := s.client.Post(endpoint+gateway+"/auth/authenticate", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer r.Body.Close()
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return "", err
+	}
+	if r.StatusCode != http.StatusOK {
+		return "", errors.New("Couldn't authenticate : " + gatewayError(r, b).Error())
+	}
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(b, &resp); err != nil {
+		return "", errors.New("Couldn't authenticate : " + err.Error())
+	}
+	s.token = resp.Token
+	return s.token, nil
+}
+
+// dropToken forgets token once etcd refused it, so that the next call
+// authenticates again.
+func (s *etcdV3Store) dropToken(token string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.token == token {
+		s.token = ""
+	}
+}
+
+// post posts body to the gateway method of endpoint with client,
+// authenticating again once if etcd refused the token.
+func (s *etcdV3Store) post(client *http.Client, endpoint, method string, body []byte) (*http.Response, error) {
+	gateway, err := s.v3Gateway(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	for retry := true; ; retry = false {
+		token, err := s.authToken(endpoint, gateway)
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest("POST", endpoint+gateway+method, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		r, err := client.Do(req)
+		if err != nil || r.StatusCode != http.StatusUnauthorized || token == "" || !retry {
+			return r, err
+		}
+		// The token expired
+		r.Body.Close()
+		s.dropToken(token)
+	}
+}
+
+// gatewayError returns the error the gateway answered with in b.
+func gatewayError(r *http.Response, b []byte) error {
+	var gwErr struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(b, &gwErr) == nil && (gwErr.Message != "" || gwErr.Error != "") {
+		return errors.New(gwErr.Message + gwErr.Error)
+	}
+	return errors.New(r.Status)
+}
+
+// call posts req to the gateway method, trying each endpoint until one
+// answers, and decodes its answer into resp. An endpoint failing with a
+// server error is left for the next one, other errors being the same on
+// every endpoint.
+func (s *etcdV3Store) call(method string, req, resp interface{}) (err error) {
+	defer observeEtcd(strings.TrimPrefix(method, "/"), time.Now(), &err)
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for _, endpoint := range s.endpoints {
+		r, err := s.post(s.client, endpoint, method, body)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if r.StatusCode >= http.StatusInternalServerError {
+			lastErr = gatewayError(r, b)
+			continue
+		}
+		if r.StatusCode != http.StatusOK {
+			return gatewayError(r, b)
+		}
+		if resp == nil {
+			return nil
+		}
+		return json.Unmarshal(b, resp)
+	}
+	return errors.New("No etcd endpoint available: " + lastErr.Error())
+}
+
+func b64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func unb64(s string) string {
+	b, _ := base64.StdEncoding.DecodeString(s)
+	return string(b)
+}
+
+// dirPrefix is the prefix of the keys under dir, which /a/b is but /a/bc isn't.
+func dirPrefix(dir string) string {
+	return strings.TrimSuffix(dir, "/") + "/"
+}
+
+// prefixEnd returns the end of the range of keys starting with prefix.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	// Only 0xff bytes, meaning every key after prefix
+	return "\x00"
+}
+
+func (s *etcdV3Store) Get(key string) (string, bool, error) {
+	var resp etcdV3RangeResponse
+	if err := s.call("/kv/range", map[string]string{"key": b64(key)}, &resp); err != nil {
+		return "", false, errors.New("Couldn't get key " + key + " : " + err.Error())
+	}
+	if len(resp.Kvs) == 0 {
+		return "", false, nil
+	}
+	return unb64(resp.Kvs[0].Value), true, nil
+}
+
+func (s *etcdV3Store) List(dir string) (map[string]string, error) {
+	var resp etcdV3RangeResponse
+	dir = dirPrefix(dir)
+	req := map[string]string{"key": b64(dir), "range_end": b64(prefixEnd(dir))}
+	if err := s.call("/kv/range", req, &resp); err != nil {
+		return nil, errors.New("Couldn't list " + dir + " : " + err.Error())
+	}
+	kvs := map[string]string{}
+	for _, kv := range resp.Kvs {
+		kvs[unb64(kv.Key)] = unb64(kv.Value)
+	}
+	return kvs, nil
+}
+
+func (s *etcdV3Store) Create(key, val string) error {
+	var resp struct {
+		Succeeded bool `json:"succeeded"`
+	}
+	req := map[string]interface{}{
+		"compare": []map[string]string{{
+			"key":             b64(key),
+			"target":          "CREATE",
+			"result":          "EQUAL",
+			"create_revision": "0",
+		}},
+		"success": []map[string]interface{}{{
+			"request_put": map[string]string{"key": b64(key), "value": b64(val)},
+		}},
+	}
+	if err := s.call("/kv/txn", req, &resp); err != nil {
+		return errors.New("Couldn't create key " + key + " : " + err.Error())
+	}
+	if !resp.Succeeded {
+		return errors.New("Couldn't create key " + key + " : Key already exists")
+	}
+	return nil
+}
+
+func (s *etcdV3Store) Set(key, val string) error {
+	if err := s.call("/kv/put", map[string]string{"key": b64(key), "value": b64(val)}, nil); err != nil {
+		return errors.New("Couldn't set key " + key + " : " + err.Error())
+	}
+	return nil
+}
+
+func (s *etcdV3Store) Delete(key string) error {
+	if err := s.call("/kv/deleterange", map[string]string{"key": b64(key)}, nil); err != nil {
+		return errors.New("Couldn't delete key " + key + " : " + err.Error())
+	}
+	return nil
+}
+
+func (s *etcdV3Store) Check() error {
+	var resp etcdV3RangeResponse
+	return s.call("/kv/range", map[string]interface{}{"key": b64("/"), "count_only": true}, &resp)
+}
+
+func (s *etcdV3Store) Txn(ops []storeOp) error {
+	requests := []map[string]interface{}{}
+	for _, op := range ops {
+		switch op.Type {
+		case opSet:
+			requests = append(requests, map[string]interface{}{
+				"request_put": map[string]string{"key": b64(op.Key), "value": b64(op.Value)},
+			})
+		case opDelete:
+			requests = append(requests, map[string]interface{}{
+				"request_delete_range": map[string]string{"key": b64(op.Key)},
+			})
+		}
+	}
+	if err := s.call("/kv/txn", map[string]interface{}{"success": requests}, nil); err != nil {
+		return errors.New("Couldn't commit transaction : " + err.Error())
+	}
+	return nil
+}
+
+func (s *etcdV3Store) MaxTxnOps() int {
+	return s.maxOps
+}
+
+func (s *etcdV3Store) Watch(dir string, fn func(storeEvent)) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"create_request": map[string]string{"key": b64(dirPrefix(dir)), "range_end": b64(prefixEnd(dirPrefix(dir)))},
+	})
+	if err != nil {
+		return err
+	}
+	var r *http.Response
+	for _, endpoint := range s.endpoints {
+		if r, err = s.post(s.watcher, endpoint, "/watch", body); err != nil {
+			continue
+		}
+		if r.StatusCode == http.StatusOK {
+			break
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err = gatewayError(r, b); r.StatusCode < http.StatusInternalServerError {
+			break
+		}
+	}
+	if err != nil {
+		return errors.New("Couldn't watch " + dir + " : " + err.Error())
+	}
+	defer r.Body.Close()
+	dec := json.NewDecoder(r.Body)
+	for {
+		var resp struct {
+			Result struct {
+				Canceled     bool   `json:"canceled"`
+				CancelReason string `json:"cancel_reason"`
+				Events       []struct {
+					Type string         `json:"type"`
+					Kv   etcdV3KeyValue `json:"kv"`
+				} `json:"events"`
+			} `json:"result"`
+		}
+		if err := dec.Decode(&resp); err != nil {
+			return errors.New("Couldn't watch " + dir + " : " + err.Error())
+		}
+		if resp.Result.Canceled {
+			return errors.New("Watch of " + dir + " canceled: " + resp.Result.CancelReason)
+		}
+		for _, ev := range resp.Result.Events {
+			revision, _ := strconv.ParseUint(ev.Kv.ModRevision, 10, 64)
+			fn(storeEvent{
+				Key:      unb64(ev.Kv.Key),
+				Value:    unb64(ev.Kv.Value),
+				Deleted:  ev.Type == "DELETE",
+				Revision: revision,
+			})
+		}
+	}
+}
+
+func (s *etcdV3Store) Acquire(key, val string, ttl time.Duration) (bool, error) {
+	s.leaseLock.Lock()
+	defer s.leaseLock.Unlock()
+	if s.lease != "" {
+		var resp struct {
+			Result struct {
+				TTL string `json:"TTL"`
+			} `json:"result"`
+		}
+		if err := s.call("/lease/keepalive", map[string]string{"ID": s.lease}, &resp); err != nil {
+			return false, errors.New("Couldn't keep lease alive : " + err.Error())
+		}
+		if resp.Result.TTL != "" && resp.Result.TTL != "0" {
+			current, ok, err := s.Get(key)
+			if err != nil {
+				return false, err
+			}
+			if ok && current == val {
+				return true, nil
+			}
+			// The key was taken over, the lease holds nothing anymore
+			s.call("/kv/lease/revoke", map[string]string{"ID": s.lease}, nil)
+		}
+		// The lease expired, or was revoked
+		s.lease = ""
+	}
+	var grant struct {
+		ID string `json:"ID"`
+	}
+	req := map[string]interface{}{"TTL": int64(ttl / time.Second)}
+	if err := s.call("/lease/grant", req, &grant); err != nil {
+		return false, errors.New("Couldn't grant lease : " + err.Error())
+	}
+	var resp struct {
+		Succeeded bool `json:"succeeded"`
+	}
+	txn := map[string]interface{}{
+		"compare": []map[string]string{{
+			"key":             b64(key),
+			"target":          "CREATE",
+			"result":          "EQUAL",
+			"create_revision": "0",
+		}},
+		"success": []map[string]interface{}{{
+			"request_put": map[string]string{"key": b64(key), "value": b64(val), "lease": grant.ID},
+		}},
+	}
+	if err := s.call("/kv/txn", txn, &resp); err != nil {
+		return false, errors.New("Couldn't acquire key " + key + " : " + err.Error())
+	}
+	if !resp.Succeeded {
+		s.call("/kv/lease/revoke", map[string]string{"ID": grant.ID}, nil)
+		return false, nil
+	}
+	s.lease = grant.ID
+	return true, nil
+}
+
+func (s *etcdV3Store) Release(key, val string) error {
+	s.leaseLock.Lock()
+	defer s.leaseLock.Unlock()
+	if s.lease == "" {
+		return nil
+	}
+	// Revoking the lease deletes the key
+	if err := s.call("/kv/lease/revoke", map[string]string{"ID": s.lease}, nil); err != nil {
+		return errors.New("Couldn't release key " + key + " : " + err.Error())
+	}
+	s.lease = ""
+	return nil
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGateway serves the parts of the etcd v3 JSON gateway the store uses,
+// from an in-memory map.
+type fakeGateway struct {
+	sync.Mutex
+	version string
+	// status is answered to every call when set
+	status int
+	// token is required in the Authorization header when set
+	token string
+	kvs   map[string]string
+	calls []string
+	// leases holds the keys attached to each lease
+	leases map[string][]string
+}
+
+func newFakeGateway(version string) *fakeGateway {
+	return &fakeGateway{version: version, kvs: map[string]string{}, leases: map[string][]string{}}
+}
+
+func (g *fakeGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.Lock()
+	defer g.Unlock()
+	g.calls = append(g.calls, r.URL.Path)
+	if r.URL.Path == "/version" {
+		w.Write([]byte(`{"etcdserver":"` + g.version + `","etcdcluster":"3.0.0"}`))
+		return
+	}
+	if g.status != 0 {
+		http.Error(w, `{"error":"etcdserver: unavailable","code":14}`, g.status)
+		return
+	}
+	var req map[string]interface{}
+	body, _ := ioutil.ReadAll(r.Body)
+	json.Unmarshal(body, &req)
+	method := r.URL.Path[strings.Index(r.URL.Path[1:], "/")+1:]
+	if method == "/auth/authenticate" {
+		if req["name"] != "root" || req["password"] != "secret" {
+			http.Error(w, `{"error":"etcdserver: authentication failed","code":3}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"token": g.token})
+		return
+	}
+	if g.token != "" && r.Header.Get("Authorization") != g.token {
+		http.Error(w, `{"error":"etcdserver: invalid auth token","code":16}`, http.StatusUnauthorized)
+		return
+	}
+	str := func(field string) string {
+		s, _ := req[field].(string)
+		return unb64(s)
+	}
+	switch method {
+	case "/kv/range":
+		kvs := []map[string]string{}
+		keys := []string{}
+		for key := range g.kvs {
+			if key == str("key") || (req["range_end"] != nil && key >= str("key") && key < str("range_end")) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			kvs = append(kvs, map[string]string{"key": b64(key), "value": b64(g.kvs[key])})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"kvs": kvs})
+	case "/kv/put":
+		g.kvs[str("key")] = str("value")
+		w.Write([]byte(`{}`))
+	case "/kv/deleterange":
+		delete(g.kvs, str("key"))
+		w.Write([]byte(`{}`))
+	case "/kv/txn":
+		requests, _ := req["success"].([]interface{})
+		if len(requests) > 2 {
+			http.Error(w, `{"error":"etcdserver: too many operations in txn request","code":3}`, http.StatusBadRequest)
+			return
+		}
+		// The only comparison used is that the key doesn't exist
+		compare, _ := req["compare"].([]interface{})
+		for _, c := range compare {
+			if _, ok := g.kvs[unb64(c.(map[string]interface{})["key"].(string))]; ok {
+				w.Write([]byte(`{"succeeded":false}`))
+				return
+			}
+		}
+		for _, request := range requests {
+			op := request.(map[string]interface{})
+			if put, ok := op["request_put"].(map[string]interface{}); ok {
+				key := unb64(put["key"].(string))
+				g.kvs[key] = unb64(put["value"].(string))
+				if lease, ok := put["lease"].(string); ok {
+					g.leases[lease] = append(g.leases[lease], key)
+				}
+			}
+			if del, ok := op["request_delete_range"].(map[string]interface{}); ok {
+				delete(g.kvs, unb64(del["key"].(string)))
+			}
+		}
+		w.Write([]byte(`{"succeeded":true}`))
+	case "/lease/grant":
+		id := strconv.Itoa(len(g.calls))
+		g.leases[id] = []string{}
+		json.NewEncoder(w).Encode(map[string]string{"ID": id})
+	case "/lease/keepalive":
+		ttl := "0"
+		if _, ok := g.leases[req["ID"].(string)]; ok {
+			ttl = "10"
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"result": map[string]string{"TTL": ttl}})
+	case "/kv/lease/revoke":
+		id := req["ID"].(string)
+		for _, key := range g.leases[id] {
+			delete(g.kvs, key)
+		}
+		delete(g.leases, id)
+		w.Write([]byte(`{}`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestEtcdV3Gateway(t *testing.T) {
+	tests := []struct {
+		version string
+		gateway string
+		want    string
+	}{
+		{version: "3.2.24", want: "/v3alpha"},
+		{version: "3.3.1", want: "/v3beta"},
+		{version: "3.4.0", want: "/v3"},
+		{version: "3.5.9", want: "/v3"},
+		{version: "3.3.1", gateway: "v3/", want: "/v3"},
+	}
+	for _, test := range tests {
+		g := newFakeGateway(test.version)
+		server := httptest.NewServer(g)
+		s, err := newEtcdV3Store([]string{server.URL}, &http.Transport{}, "", "", test.gateway, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Set("/a", "1")
+		server.Close()
+		if last := g.calls[len(g.calls)-1]; last != test.want+"/kv/put" {
+			t.Errorf("%s %q: called %s, want %s/kv/put", test.version, test.gateway, last, test.want)
+		}
+	}
+}
+
+func TestEtcdV3Failover(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		ok     bool
+	}{
+		{"unavailable", http.StatusServiceUnavailable, true},
+		{"internal error", http.StatusInternalServerError, true},
+		{"bad request", http.StatusBadRequest, false},
+	}
+	for _, test := range tests {
+		down, up := newFakeGateway("3.3.1"), newFakeGateway("3.3.1")
+		down.status = test.status
+		up.kvs["/a"] = "1"
+		downServer, upServer := httptest.NewServer(down), httptest.NewServer(up)
+		s, _ := newEtcdV3Store([]string{downServer.URL, upServer.URL}, &http.Transport{}, "", "", "", 2)
+		val, ok, err := s.Get("/a")
+		downServer.Close()
+		upServer.Close()
+		if test.ok && (err != nil || !ok || val != "1") {
+			t.Errorf("%s: got %q, %v, %v, want the value of the next endpoint", test.name, val, ok, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: got %q, want the error of the first endpoint", test.name, val)
+		}
+	}
+	s, _ := newEtcdV3Store([]string{"http://127.0.0.1:1"}, &http.Transport{}, "", "", "/v3", 2)
+	if err := s.Check(); err == nil {
+		t.Error("unreachable endpoint: want an error")
+	}
+}
+
+func TestEtcdV3Auth(t *testing.T) {
+	g := newFakeGateway("3.4.0")
+	g.token = "t1"
+	server := httptest.NewServer(g)
+	defer server.Close()
+	s, _ := newEtcdV3Store([]string{server.URL}, &http.Transport{}, "root", "secret", "", 2)
+	if err := s.Set("/a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	// The token expires
+	g.Lock()
+	g.token = "t2"
+	g.Unlock()
+	if val, ok, err := s.Get("/a"); err != nil || !ok || val != "1" {
+		t.Errorf("got %q, %v, %v after the token expired", val, ok, err)
+	}
+	wrong, _ := newEtcdV3Store([]string{server.URL}, &http.Transport{}, "root", "wrong", "", 2)
+	if err := wrong.Set("/a", "2"); err == nil {
+		t.Error("wrong password: want an error")
+	}
+}
+
+func TestEtcdV3Store(t *testing.T) {
+	g := newFakeGateway("3.4.0")
+	g.kvs = map[string]string{"/p/a": "1", "/p/b/c": "2", "/pp/d": "3"}
+	server := httptest.NewServer(g)
+	defer server.Close()
+	s, _ := newEtcdV3Store([]string{server.URL}, &http.Transport{}, "", "", "", 2)
+	kvs, err := s.List("/p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 2 || kvs["/p/a"] != "1" || kvs["/p/b/c"] != "2" {
+		t.Errorf("List(/p) = %v, want the keys under /p only", kvs)
+	}
+	ops := []storeOp{{Type: opSet, Key: "/p/e", Value: "5"}, {Type: opDelete, Key: "/p/a"}}
+	if err := s.Txn(ops); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := g.kvs["/p/a"]; ok || g.kvs["/p/e"] != "5" {
+		t.Errorf("got %v after the transaction", g.kvs)
+	}
+	if err := s.Txn(append(ops, ops...)); err == nil {
+		t.Error("transaction over the limit: want an error")
+	}
+}
+
+func TestEtcdV3Lease(t *testing.T) {
+	g := newFakeGateway("3.4.0")
+	server := httptest.NewServer(g)
+	defer server.Close()
+	s, _ := newEtcdV3Store([]string{server.URL}, &http.Transport{}, "", "", "", 2)
+	other, _ := newEtcdV3Store([]string{server.URL}, &http.Transport{}, "", "", "", 2)
+	if ok, err := s.Acquire("/leader", "a", 10*time.Second); err != nil || !ok {
+		t.Fatalf("got %v, %v, want the key", ok, err)
+	}
+	if ok, err := other.Acquire("/leader", "b", 10*time.Second); err != nil || ok {
+		t.Errorf("got %v, %v while the key is held", ok, err)
+	}
+	if ok, err := s.Acquire("/leader", "a", 10*time.Second); err != nil || !ok {
+		t.Errorf("got %v, %v keeping the key", ok, err)
+	}
+
+	// The key is taken over while the lease is still alive
+	g.Lock()
+	lease := s.lease
+	g.leases[lease] = []string{}
+	g.kvs["/leader"] = "b"
+	g.Unlock()
+	if ok, err := s.Acquire("/leader", "a", 10*time.Second); err != nil || ok {
+		t.Errorf("got %v, %v after a takeover", ok, err)
+	}
+	if _, ok := g.leases[lease]; ok || s.lease != "" {
+		t.Errorf("lease %s wasn't revoked after a takeover", lease)
+	}
+
+	delete(g.kvs, "/leader")
+	if ok, err := s.Acquire("/leader", "a", 10*time.Second); err != nil || !ok {
+		t.Fatalf("got %v, %v, want the key", ok, err)
+	}
+	if err := s.Release("/leader", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := g.kvs["/leader"]; ok || len(g.leases) != 0 {
+		t.Errorf("got %v and leases %v after the release", g.kvs, g.leases)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	gitobj "gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// exportKeys writes every key under prefix to the file of dir it would be
+// synced from by repo, and returns the paths of the written files relative to
+// dir. Keys that wouldn't be synced back to themselves, like the ones coming
+// from structured or ignored files, are skipped.
+func exportKeys(repo *syncedRepo, prefix, dir string) ([]string, error) {
+	prefix = "/" + strings.Trim(prefix, "/")
+	kvs, err := store.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := newFileFilter(nil)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, key := range sortedKeys(kvs) {
+		if !underPrefix(key, prefix) || underPrefix(key, stateDir()) {
+			continue
+		}
+		logger := log.WithField("key", key)
+		name, ok := keyFile(repo.Prefix, key)
+		if !ok {
+			logger.Warn("No file maps to key, skipping it")
+			continue
+		}
+		logger = logger.WithField("name", name)
+		if matchParseRule(name) != nil || !filter.synced(name) {
+			logger.Warn("File would be parsed or ignored, skipping key")
+			continue
+		}
+		if strings.TrimSpace(kvs[key]) != kvs[key] {
+			logger.Warn("Leading and trailing spaces of the value won't be synced back")
+		}
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			logger.WithError(err).Warn("Couldn't create directory")
+			continue
+		}
+		// Files get back the trailing newline the sync trims
+		if err := ioutil.WriteFile(file, []byte(kvs[key]+"\n"), 0644); err != nil {
+			logger.WithError(err).Warn("Couldn't write file")
+			continue
+		}
+		files = append(files, name)
+	}
+	return files, nil
+}
+
+// exportBranch opens the repo in dir, or initializes it, and checks out a new
+// branch from its head.
+func exportBranch(dir, branch string) (*git.Repository, error) {
+	repo, err := git.PlainOpen(dir)
+	if err == git.ErrRepositoryNotExists {
+		repo, err = git.PlainInit(dir, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ref := plumbing.ReferenceName("refs/heads/" + branch)
+	if _, err := repo.Head(); err == plumbing.ErrReferenceNotFound {
+		// No commit yet, the branch is created by the first one
+		return repo, repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, ref))
+	} else if err != nil {
+		return nil, errors.New("Couldn't get head: " + err.Error())
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		return nil, errors.New("Couldn't get WorkTree: " + err.Error())
+	}
+	if err := wt.Checkout(&git.CheckoutOptions{Branch: ref, Create: true}); err != nil {
+		return nil, errors.New("Couldn't create branch " + branch + ": " + err.Error())
+	}
+	return repo, nil
+}
+
+func commitExport(repo *git.Repository, files []string, msg string, author *gitobj.Signature) (plumbing.Hash, error) {
+	wt, err := repo.Worktree()
+	if err != nil {
+		return plumbing.ZeroHash, errors.New("Couldn't get WorkTree: " + err.Error())
+	}
+	for _, file := range files {
+		if _, err := wt.Add(file); err != nil {
+			return plumbing.ZeroHash, errors.New("Couldn't add " + file + ": " + err.Error())
+		}
+	}
+	return wt.Commit(msg, &git.CommitOptions{Author: author})
+}
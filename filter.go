@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/spf13/viper"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/gitignore"
+	gitobj "gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+const ignoreFile = ".git2etcdignore"
+
+// fileFilter tells which files of a tree are synced, according to the
+// .git2etcdignore file of the tree and the repo.include and repo.exclude
+// patterns.
+type fileFilter struct {
+	include gitignore.Matcher
+	exclude gitignore.Matcher
+}
+
+// newFileFilter returns the filter of tree, or the one only made of the
+// configured patterns if tree is nil.
+func newFileFilter(tree *gitobj.Tree) (*fileFilter, error) {
+	excludes := parsePatterns(viper.GetStringSlice("repo.exclude"))
+	if tree != nil {
+		f, err := tree.File(ignoreFile)
+		if err == nil {
+			content, err := f.Contents()
+			if err != nil {
+				return nil, errors.New("Couldn't read " + ignoreFile + ": " + err.Error())
+			}
+			excludes = append(excludes, parsePatterns(strings.Split(content, "\n"))...)
+		} else if err != gitobj.ErrFileNotFound {
+			return nil, errors.New("Couldn't get " + ignoreFile + ": " + err.Error())
+		}
+	}
+	filter := &fileFilter{exclude: gitignore.NewMatcher(excludes)}
+	if includes := parsePatterns(viper.GetStringSlice("repo.include")); len(includes) > 0 {
+		filter.include = gitignore.NewMatcher(includes)
+	}
+	return filter, nil
+}
+
+// parsePatterns reads gitignore patterns, skipping blank lines and comments.
+func parsePatterns(lines []string) []gitignore.Pattern {
+	patterns := []gitignore.Pattern{}
+	for _, line := range lines {
+		p := strings.TrimRight(line, " \t\r")
+		if p == "" || strings.HasPrefix(p, "#") {
+			continue
+		}
+		patterns = append(patterns, gitignore.ParsePattern(p, nil))
+	}
+	return patterns
+}
+
+func (f *fileFilter) synced(name string) bool {
+	if name == ignoreFile {
+		return false
+	}
+	parts := strings.Split(name, "/")
+	if f.include != nil && !f.include.Match(parts, false) {
+		return false
+	}
+	return !f.exclude.Match(parts, false)
+}
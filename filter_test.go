@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestFileFilter(t *testing.T) {
+	defer viper.Reset()
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		ignore  string
+		synced  map[string]bool
+	}{
+		{
+			name:   "everything",
+			synced: map[string]bool{"a": true, "dir/b": true, ignoreFile: false},
+		},
+		{
+			name:   "ignore file",
+			ignore: "# secrets\n*.key\n\ntmp/\n!keep.key\n",
+			synced: map[string]bool{"a": true, "a.key": false, "dir/b.key": false, "keep.key": true, "tmp/c": false, "dir/tmp/c": false},
+		},
+		{
+			name:    "include and exclude",
+			include: []string{"app/"},
+			exclude: []string{"*.bak"},
+			synced:  map[string]bool{"app/a": true, "app/a.bak": false, "other/a": false},
+		},
+		{
+			name:    "include and ignore file",
+			include: []string{"*.json"},
+			ignore:  "drafts/\n",
+			synced:  map[string]bool{"a.json": true, "drafts/a.json": false, "a.yml": false},
+		},
+	}
+	for _, test := range tests {
+		viper.Set("repo.include", test.include)
+		viper.Set("repo.exclude", test.exclude)
+		files := map[string]string{"a": "1"}
+		if test.ignore != "" {
+			files[ignoreFile] = test.ignore
+		}
+		tree, err := testCommit(t, newTestRepo(t), files).Tree()
+		if err != nil {
+			t.Fatal(err)
+		}
+		filter, err := newFileFilter(tree)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		for name, want := range test.synced {
+			if got := filter.synced(name); got != want {
+				t.Errorf("%s: synced(%q) = %v, want %v", test.name, name, got, want)
+			}
+		}
+	}
+}
+
+func TestSyncedFilesIgnored(t *testing.T) {
+	tree, err := testCommit(t, newTestRepo(t), map[string]string{"a": "1", "b": "2", ignoreFile: "b\n"}).Tree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	synced, ignored, err := syncedFiles(&syncedRepo{}, tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]bool{}
+	for _, f := range ignored {
+		names[f.Name] = true
+	}
+	if len(synced) != 1 || synced[0].Name != "a" || !names["b"] {
+		t.Errorf("got %v synced and %v ignored, want a synced and b ignored", synced, names)
+	}
+}
+
+func TestDiffOpsIgnoreFile(t *testing.T) {
+	r := newTestRepo(t)
+	from := testCommit(t, r, map[string]string{"a": "1"})
+	tree, err := testCommit(t, r, map[string]string{"a": "1", ignoreFile: "a\n"}).Tree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A full sync follows, the files of the applied commit being synced
+	// under other rules
+	if ops, err := diffOps(&syncedRepo{Prefix: "/p", git: r}, from.Hash, tree); err == nil {
+		t.Errorf("got %+v, want an error", ops)
+	}
+}
@@ -4,9 +4,10 @@ import (
 	"errors"
 	"io/ioutil"
 	"os"
+	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/spf13/viper"
 	"golang.org/x/crypto/ssh"
 	"gopkg.in/src-d/go-git.v4"
 	"gopkg.in/src-d/go-git.v4/plumbing"
@@ -16,97 +17,141 @@ import (
 	gitssh "gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
 )
 
-func openOrCloneRepo() error {
+func openOrCloneRepo(repo *syncedRepo) error {
 	var err error
-	gitRepo, err = git.PlainOpen(viper.GetString("repo.path"))
-	if err != nil || gitRepo == nil {
+	repo.git, err = git.PlainOpen(repo.Path)
+	if err != nil || repo.git == nil {
 		log.WithError(err).Warn("Couldn't find repo locally, trying to clone it")
 		cloneOptions := &git.CloneOptions{}
-		cloneOptions.URL = viper.GetString("repo.url")
-		cloneOptions.Auth, err = getGitAuth()
+		cloneOptions.URL = repo.URL
+		cloneOptions.Auth, err = getGitAuth(repo.Auth)
 		if err != nil {
 			return err
 		}
-		if viper.GetString("repo.branch") == "" {
-			// Default value is not correctly assigned to repo.branch when using json config, forcing it here
-			viper.Set("repo.branch", "master")
-		}
 		cloneOptions.SingleBranch = true
-		cloneOptions.Depth = 1
+		cloneOptions.Depth = repo.Depth
 		cloneOptions.Tags = git.NoTags
+		if kind, _ := trackedRef(repo); kind == refTag || kind == refTagPattern {
+			cloneOptions.Tags = git.AllTags
+		}
 		cloneOptions.Progress = os.Stdout
-		cloneOptions.ReferenceName = plumbing.ReferenceName("refs/heads/" + viper.GetString("repo.branch"))
+		cloneOptions.ReferenceName = branchRef(repo)
 		log.WithFields(log.Fields{
-			"url":    viper.GetString("repo.url"),
-			"branch": viper.GetString("repo.branch"),
-			"path":   viper.GetString("repo.path"),
+			"url":    repo.URL,
+			"branch": repo.Branch,
+			"ref":    repo.Ref,
+			"path":   repo.Path,
 			"depth":  cloneOptions.Depth,
 		}).Info("Cloning repo")
-		gitRepo, err = git.PlainClone(viper.GetString("repo.path"), false, cloneOptions)
+		repo.git, err = git.PlainClone(repo.Path, false, cloneOptions)
 
 		if err != nil {
 			return err
 		}
 		log.Info("Clone end")
 	}
-	if err := syncRepo(gitRepo); err != nil {
-		log.WithError(err).Warn("Couldn't sync repo")
-	}
 	return nil
 }
 
-func syncRepo(repo *git.Repository) error {
-	wt, err := repo.Worktree()
+// syncRepo applies the head of the branch, lifting the pin of a rollback. A
+// full sync writes the whole tree, and prunes if enabled, even when the head
+// is already applied.
+func syncRepo(repo *syncedRepo, full bool) error {
+	commit, err := pullHead(repo)
 	if err != nil {
-		return errors.New("Couldn't get WorkTree: " + err.Error())
+		return err
 	}
-	po := &git.PullOptions{
-		ReferenceName: plumbing.ReferenceName("refs/heads/" + viper.GetString("repo.branch")),
+	log.Info("Pulling end, Start to write on Etcd")
+	return syncCommit(repo, commit, full)
+}
+
+// syncCommit applies commit and unpins the store, commit being what an
+// explicit sync brings it back to.
+func syncCommit(repo *syncedRepo, commit *gitobj.Commit, full bool) error {
+	if err := applyCommit(repo, commit, full); err != nil {
+		return err
 	}
-	po.Auth, err = getGitAuth()
+	return setPinned(repo, plumbing.ZeroHash)
+}
+
+// pullHead pulls the repo and returns the commit to sync: its new head, or
+// the one repo.ref designates.
+func pullHead(repo *syncedRepo) (*gitobj.Commit, error) {
+	start := time.Now()
+	if kind, _ := trackedRef(repo); kind != refBranch {
+		err := fetchRepo(repo)
+		observeSince("git2etcd_git_pull_duration_seconds", metricLabels("repo", repo.Name, "result", metricResult(err)), start)
+		if err != nil {
+			return nil, err
+		}
+		return resolveRef(repo)
+	}
+	err := pullRepo(repo)
+	observeSince("git2etcd_git_pull_duration_seconds", metricLabels("repo", repo.Name, "result", metricResult(err)), start)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if err := wt.Pull(po); err != nil && err != git.NoErrAlreadyUpToDate {
-		return errors.New("Couldn't pull: " + err.Error())
+	head, err := repo.git.Head()
+	if err != nil {
+		return nil, errors.New("Couldn't checkout head: " + err.Error())
 	}
-	head, err := repo.Head()
+	commit, err := repo.git.CommitObject(head.Hash())
 	if err != nil {
-		return errors.New("Couldn't checkout head: " + err.Error())
+		return nil, errors.New("Couldn't get commit: " + err.Error())
 	}
-	commit, err := repo.CommitObject(head.Hash())
+	return commit, nil
+}
+
+func pullRepo(repo *syncedRepo) error {
+	wt, err := repo.git.Worktree()
 	if err != nil {
-		return errors.New("Couldn't get commit: " + err.Error())
+		return errors.New("Couldn't get WorkTree: " + err.Error())
+	}
+	po := &git.PullOptions{
+		ReferenceName: branchRef(repo),
+		Force:         true,
 	}
-	tree, err := commit.Tree()
+	po.Auth, err = getGitAuth(repo.Auth)
 	if err != nil {
-		return errors.New("Couldn't get commit tree: " + err.Error())
+		return err
 	}
-	log.Info("Pulling end, Start to write on Etcd")
-	err = tree.Files().ForEach(func(f *gitobj.File) error {
-		if !etcdExists(f.Name) {
-			if err := etcdCreate(f.Name); err != nil {
-				log.WithError(err).WithField("name", f.Name).Warn("Couldn't create key")
-			}
-		} else {
-			if err := etcdSet(f.Name); err != nil {
-				log.WithError(err).WithField("name", f.Name).Warn("Couldn't set key")
-			}
+	err = wt.Pull(po)
+	if err != nil && err.Error() == "non-fast-forward update" {
+		// The branch was force-pushed, the clone is only a mirror so follow it
+		ref, err := repo.git.Reference(remoteBranchRef(repo), true)
+		if err != nil {
+			return errors.New("Couldn't get remote branch: " + err.Error())
+		}
+		log.WithField("commit", ref.Hash().String()).Warn("Branch was force-pushed, resetting to it")
+		if err := wt.Reset(&git.ResetOptions{Commit: ref.Hash(), Mode: git.HardReset}); err != nil {
+			return errors.New("Couldn't reset to remote branch: " + err.Error())
 		}
 		return nil
-	})
-	if err != nil {
-		return errors.New("Couldn't walk in files: " + err.Error())
 	}
-	log.Info("Repo synced")
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return errors.New("Couldn't pull: " + err.Error())
+	}
 	return nil
 }
 
-func getGitAuth() (gittransport.AuthMethod, error) {
-	if viper.GetString("auth.type") == "ssh" {
+// remoteBranchRef is the remote-tracking ref of the branch of branchRef.
+func remoteBranchRef(repo *syncedRepo) plumbing.ReferenceName {
+	return plumbing.ReferenceName("refs/remotes/origin/" + strings.TrimPrefix(branchRef(repo).String(), "refs/heads/"))
+}
+
+// branchRef is the branch to clone and pull, the one of repo.ref if any.
+func branchRef(repo *syncedRepo) plumbing.ReferenceName {
+	if kind, name := trackedRef(repo); kind == refBranch {
+		return plumbing.ReferenceName("refs/heads/" + name)
+	}
+	return plumbing.ReferenceName("refs/heads/" + repo.Branch)
+}
+
+func getGitAuth(auth repoAuth) (gittransport.AuthMethod, error) {
+	if auth.Type == "ssh" {
 		log.Info("Check with ssh key")
 		var signer ssh.Signer
-		sshFile, err := os.Open(viper.GetString("auth.ssh.key"))
+		sshFile, err := os.Open(auth.SSH.Key)
 		if err != nil {
 			return nil, errors.New("Couldn't open SSH key: " + err.Error())
 		}
@@ -114,8 +159,8 @@ func getGitAuth() (gittransport.AuthMethod, error) {
 		if err != nil {
 			return nil, errors.New("Couldn't read SSH key: " + err.Error())
 		}
-		if viper.GetString("auth.ssh.passphrase") != "" {
-			signer, err = ssh.ParsePrivateKeyWithPassphrase(sshB, []byte(viper.GetString("auth.ssh.passphrase")))
+		if auth.SSH.Passphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(sshB, []byte(auth.SSH.Passphrase))
 		} else {
 			signer, err = ssh.ParsePrivateKey(sshB)
 		}
@@ -126,8 +171,8 @@ func getGitAuth() (gittransport.AuthMethod, error) {
 		return sshAuth, nil
 	}
 	httpAuth := &githttp.BasicAuth{
-		Username: viper.GetString("auth.http.username"),
-		Password: viper.GetString("auth.http.password"),
+		Username: auth.HTTP.Username,
+		Password: auth.HTTP.Password,
 	}
 	return httpAuth, nil
 }
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// syncStatus is the outcome of the last sync job of a repo.
+type syncStatus struct {
+	Time   *time.Time `json:"time,omitempty"`
+	Result string     `json:"result,omitempty"`
+	Error  string     `json:"error,omitempty"`
+	// Success is the time of the last job that succeeded
+	Success *time.Time `json:"success,omitempty"`
+}
+
+// repoCommits is the state of the clone and the store after the last job of a
+// repo, copied while holding its lock.
+type repoCommits struct {
+	Head    string `json:"head,omitempty"`
+	Applied string `json:"applied,omitempty"`
+	Pinned  string `json:"pinned,omitempty"`
+}
+
+// commitsOf reads the commits of repo, whose lock must be held.
+func commitsOf(repo *syncedRepo) repoCommits {
+	var commits repoCommits
+	if repo.git != nil {
+		if head, err := repo.git.Head(); err == nil {
+			commits.Head = head.Hash().String()
+		}
+	}
+	if !repo.appliedCommit.IsZero() {
+		commits.Applied = repo.appliedCommit.String()
+	}
+	if !repo.pinnedCommit.IsZero() {
+		commits.Pinned = repo.pinnedCommit.String()
+	}
+	return commits
+}
+
+type endpointStatus struct {
+	URL     string `json:"url"`
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+}
+
+type repoStatus struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Branch string `json:"branch"`
+	Ref    string `json:"ref,omitempty"`
+	Prefix string `json:"prefix"`
+	repoCommits
+	SyncCycle int        `json:"sync_cycle"`
+	LastSync  syncStatus `json:"last_sync"`
+}
+
+var healthClient = &http.Client{Timeout: 2 * time.Second}
+
+// endpointHealth asks an etcd endpoint whether it's healthy.
+func endpointHealth(endpoint string) error {
+	resp, err := healthClient.Get(strings.TrimSuffix(endpoint, "/") + "/health")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var health struct {
+		Health string `json:"health"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		return errors.New("Couldn't read health: " + err.Error())
+	}
+	if resp.StatusCode != http.StatusOK || health.Health != "true" {
+		return errors.New("Unhealthy: " + resp.Status)
+	}
+	return nil
+}
+
+// healthzHandler tells the process is alive.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// readyzHandler tells etcd is reachable, and every repo was opened and went
+// through its first sync, by this instance when leading, or by any of them
+// otherwise.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if err := store.Check(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	leading := isLeader()
+	for _, repo := range repos {
+		if repo.git == nil {
+			http.Error(w, "Repo "+repo.Name+" isn't opened", http.StatusServiceUnavailable)
+			return
+		}
+		jobs.Lock()
+		synced := repo.lastSync.Success != nil
+		jobs.Unlock()
+		if !leading {
+			_, recorded, err := store.Get(metaDir(repo) + "/commit")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			synced = recorded
+		}
+		if !synced {
+			http.Error(w, "Repo "+repo.Name+" wasn't synced yet", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// statusHandler reports the state of the repos, of etcd and of the leader
+// election.
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	status := struct {
+		Instance string `json:"instance"`
+		Etcd     struct {
+			API       string           `json:"api"`
+			Healthy   bool             `json:"healthy"`
+			Error     string           `json:"error,omitempty"`
+			Endpoints []endpointStatus `json:"endpoints"`
+		} `json:"etcd"`
+		Repos       []repoStatus `json:"repos"`
+		Leading     bool         `json:"leading"`
+		Leader      *leaderInfo  `json:"leader,omitempty"`
+		LeaderError string       `json:"leader_error,omitempty"`
+	}{Instance: viper.GetString("host.instance"), Leading: isLeader()}
+	status.Etcd.API = viper.GetString("etcd.api")
+	status.Etcd.Healthy = true
+	if err := store.Check(); err != nil {
+		status.Etcd.Healthy, status.Etcd.Error = false, err.Error()
+	}
+	for _, endpoint := range storeHosts() {
+		s := endpointStatus{URL: endpoint, Healthy: true}
+		if err := endpointHealth(endpoint); err != nil {
+			s.Healthy, s.Error = false, err.Error()
+		}
+		status.Etcd.Endpoints = append(status.Etcd.Endpoints, s)
+	}
+	for _, repo := range repos {
+		s := repoStatus{
+			Name:      repo.Name,
+			URL:       repo.URL,
+			Branch:    repo.Branch,
+			Ref:       repo.Ref,
+			Prefix:    repo.Prefix,
+			SyncCycle: repo.SyncCycle,
+		}
+		jobs.Lock()
+		s.repoCommits = repo.commits
+		s.LastSync = repo.lastSync
+		jobs.Unlock()
+		status.Repos = append(status.Repos, s)
+	}
+	if viper.GetBool("leader.enabled") {
+		leader, err := currentLeader()
+		if err != nil {
+			status.LeaderError = err.Error()
+		}
+		status.Leader = leader
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Kinds of jobs, the automatic ones leaving alone a store pinned by a
+// rollback.
+const (
+	jobAuto     = "auto"
+	jobSync     = "sync"
+	jobFull     = "full"
+	jobRollback = "rollback"
+)
+
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+	// jobSkipped is an automatic sync left to the leader
+	jobSkipped = "skipped"
+)
+
+// syncJob is a sync of a repo waiting in its queue, running or finished.
+// Triggers coming while it's queued are merged into it.
+type syncJob struct {
+	ID   string `json:"id"`
+	Repo string `json:"repo"`
+	Kind string `json:"kind"`
+	// Rev is the revision to roll back to
+	Rev      string     `json:"rev,omitempty"`
+	Triggers []string   `json:"triggers"`
+	State    string     `json:"state"`
+	Error    string     `json:"error,omitempty"`
+	Commit   string     `json:"commit,omitempty"`
+	Queued   time.Time  `json:"queued"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	// Keys are the keys written, with the error of the ones that failed
+	Keys []keyResult `json:"keys,omitempty"`
+	done chan struct{}
+}
+
+var jobs struct {
+	sync.Mutex
+	byID map[string]*syncJob
+	// order holds the IDs of the jobs from the oldest
+	order []string
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// startWorker runs the jobs of repo one after the other.
+func startWorker(repo *syncedRepo) {
+	repo.wake = make(chan struct{}, 1)
+	go func() {
+		for range repo.wake {
+			for job := nextJob(repo); job != nil; job = nextJob(repo) {
+				runJob(repo, job)
+			}
+		}
+	}()
+}
+
+// enqueueJob queues a job for repo, or returns the queued one it merges into.
+func enqueueJob(repo *syncedRepo, kind, rev, trigger string) *syncJob {
+	jobs.Lock()
+	defer jobs.Unlock()
+	for _, job := range repo.pending {
+		if job.covers(kind, rev) {
+			job.Triggers = append(job.Triggers, trigger)
+			return job
+		}
+	}
+	job := &syncJob{
+		ID:       newJobID(),
+		Repo:     repo.Name,
+		Kind:     kind,
+		Rev:      rev,
+		Triggers: []string{trigger},
+		State:    jobQueued,
+		Queued:   time.Now(),
+		done:     make(chan struct{}),
+	}
+	repo.pending = append(repo.pending, job)
+	if jobs.byID == nil {
+		jobs.byID = map[string]*syncJob{}
+	}
+	jobs.byID[job.ID] = job
+	jobs.order = append(jobs.order, job.ID)
+	trimJobs()
+	select {
+	case repo.wake <- struct{}{}:
+	default:
+	}
+	return job
+}
+
+// covers tells whether running the job also does what a job of kind and rev
+// would: a sync covers an automatic one, and a full sync both.
+func (job *syncJob) covers(kind, rev string) bool {
+	switch {
+	case job.Kind == kind:
+		return job.Rev == rev
+	case kind == jobAuto:
+		return job.Kind == jobSync || job.Kind == jobFull
+	case kind == jobSync:
+		return job.Kind == jobFull
+	}
+	return false
+}
+
+// trimJobs forgets the oldest finished jobs beyond jobs.history.
+func trimJobs() {
+	kept := []string{}
+	extra := len(jobs.order) - viper.GetInt("jobs.history")
+	for _, id := range jobs.order {
+		if state := jobs.byID[id].State; extra > 0 && (state == jobDone || state == jobFailed || state == jobSkipped) {
+			delete(jobs.byID, id)
+			extra--
+			continue
+		}
+		kept = append(kept, id)
+	}
+	jobs.order = kept
+}
+
+func nextJob(repo *syncedRepo) *syncJob {
+	jobs.Lock()
+	defer jobs.Unlock()
+	if len(repo.pending) == 0 {
+		return nil
+	}
+	job := repo.pending[0]
+	repo.pending = repo.pending[1:]
+	now := time.Now()
+	job.State, job.Started = jobRunning, &now
+	return job
+}
+
+func runJob(repo *syncedRepo, job *syncJob) {
+	repo.results = nil
+	start := time.Now()
+	repo.lock.Lock()
+	// The rollback command or another instance may have written since
+	err := loadSyncState(repo)
+	if err == nil {
+		err = runJobKind(repo, job)
+	}
+	applied, commits := repo.appliedCommit, commitsOf(repo)
+	repo.lock.Unlock()
+	skipped := err == errNotLeading
+	if skipped {
+		err = nil
+	}
+	trigger, result := job.Triggers[0], metricResult(err)
+	if skipped {
+		result = "skipped"
+	}
+	addMetric("git2etcd_syncs_total", metricLabels("repo", repo.Name, "trigger", trigger, "result", result), 1)
+	observeSince("git2etcd_sync_duration_seconds", metricLabels("repo", repo.Name, "trigger", trigger), start)
+	if err == nil && !skipped {
+		setMetric("git2etcd_last_success_timestamp_seconds", metricLabels("repo", repo.Name), float64(time.Now().Unix()))
+	}
+	if !applied.IsZero() {
+		setMetric("git2etcd_applied_commit", metricLabels("repo", repo.Name, "commit", applied.String()), 1)
+	}
+	logger := log.WithFields(log.Fields{
+		"job":      job.ID,
+		"repo":     repo.Name,
+		"kind":     job.Kind,
+		"triggers": strings.Join(job.Triggers, ","),
+	})
+	jobs.Lock()
+	now := time.Now()
+	job.Finished = &now
+	job.Commit = applied.String()
+	job.Keys = repo.results
+	repo.commits = commits
+	switch {
+	case skipped:
+		// Followers don't sync, they don't have a sync to report
+		job.State = jobSkipped
+	case err != nil:
+		job.State, job.Error = jobFailed, err.Error()
+		logger.WithError(err).Warn("Job failed")
+	default:
+		job.State = jobDone
+		repo.lastSync.Success = &now
+	}
+	if !skipped {
+		repo.lastSync.Time, repo.lastSync.Result, repo.lastSync.Error = &now, job.State, job.Error
+	}
+	trimJobs()
+	jobs.Unlock()
+	close(job.done)
+}
+
+func runJobKind(repo *syncedRepo, job *syncJob) error {
+	switch job.Kind {
+	case jobAuto:
+		return autoSyncRepo(repo)
+	case jobSync:
+		return syncRepo(repo, false)
+	case jobFull:
+		return syncRepo(repo, true)
+	case jobRollback:
+		return rollbackRepo(repo, job.Rev)
+	}
+	return errors.New("Unknown job kind " + job.Kind)
+}
+
+// wait blocks until the job is finished and returns a copy of it.
+func (job *syncJob) wait() syncJob {
+	<-job.done
+	return job.snapshot()
+}
+
+// snapshot returns a copy of the job safe to read while it runs.
+func (job *syncJob) snapshot() syncJob {
+	jobs.Lock()
+	defer jobs.Unlock()
+	c := *job
+	c.Triggers = append([]string{}, job.Triggers...)
+	return c
+}
+
+// jobHandler serves /jobs/<id>, and the list of the jobs of /jobs from the
+// newest, optionally those of the repo parameter.
+func jobHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs"), "/")
+	if id == "" {
+		listJobs(w, r.URL.Query().Get("repo"))
+		return
+	}
+	jobs.Lock()
+	job, ok := jobs.byID[id]
+	jobs.Unlock()
+	if !ok {
+		http.Error(w, "Unknown job "+id, http.StatusNotFound)
+		return
+	}
+	writeJobs(w, http.StatusOK, job.snapshot())
+}
+
+func listJobs(w http.ResponseWriter, repo string) {
+	jobs.Lock()
+	list := []syncJob{}
+	for i := len(jobs.order) - 1; i >= 0; i-- {
+		job := jobs.byID[jobs.order[i]]
+		if repo == "" || job.Repo == repo {
+			c := *job
+			c.Triggers = append([]string{}, job.Triggers...)
+			list = append(list, c)
+		}
+	}
+	jobs.Unlock()
+	writeJobs(w, http.StatusOK, list)
+}
+
+// waitJobs waits for the jobs unless the request is async, and answers with
+// them.
+func waitJobs(w http.ResponseWriter, r *http.Request, queued []*syncJob) {
+	result := []syncJob{}
+	status := http.StatusOK
+	for _, job := range queued {
+		if r.URL.Query().Get("async") != "" {
+			result, status = append(result, job.snapshot()), http.StatusAccepted
+			continue
+		}
+		finished := job.wait()
+		if finished.State == jobFailed {
+			status = http.StatusInternalServerError
+		}
+		result = append(result, finished)
+	}
+	writeJobs(w, status, result)
+}
+
+func writeJobs(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestEnqueueJob(t *testing.T) {
+	defer viper.Reset()
+	viper.Set("jobs.history", 100)
+	type queued struct{ kind, rev string }
+	tests := []struct {
+		name    string
+		pending []queued
+		kind    string
+		rev     string
+		// merged is the index of the pending job the trigger merges into, -1
+		// when it's queued
+		merged int
+	}{
+		{name: "empty queue", kind: jobAuto, merged: -1},
+		{name: "same kind", pending: []queued{{jobAuto, ""}}, kind: jobAuto, merged: 0},
+		{name: "auto into sync", pending: []queued{{jobSync, ""}}, kind: jobAuto, merged: 0},
+		{name: "auto into full", pending: []queued{{jobRollback, "v1"}, {jobFull, ""}}, kind: jobAuto, merged: 1},
+		{name: "sync into full", pending: []queued{{jobFull, ""}}, kind: jobSync, merged: 0},
+		{name: "sync after auto", pending: []queued{{jobAuto, ""}}, kind: jobSync, merged: -1},
+		{name: "full after sync", pending: []queued{{jobSync, ""}}, kind: jobFull, merged: -1},
+		{name: "auto after rollback", pending: []queued{{jobRollback, "v1"}}, kind: jobAuto, merged: -1},
+		{name: "same rollback", pending: []queued{{jobRollback, "v1"}}, kind: jobRollback, rev: "v1", merged: 0},
+		{name: "other rollback", pending: []queued{{jobRollback, "v1"}}, kind: jobRollback, rev: "v2", merged: -1},
+	}
+	for _, test := range tests {
+		repo := &syncedRepo{Name: "r", wake: make(chan struct{}, 1)}
+		for _, q := range test.pending {
+			enqueueJob(repo, q.kind, q.rev, "first")
+		}
+		pending := append([]*syncJob{}, repo.pending...)
+		job := enqueueJob(repo, test.kind, test.rev, "second")
+		if test.merged < 0 {
+			if len(repo.pending) != len(pending)+1 || job != repo.pending[len(pending)] || job.Kind != test.kind {
+				t.Errorf("%s: merged into %+v, want a new job", test.name, job)
+			}
+			continue
+		}
+		if len(repo.pending) != len(pending) || job != pending[test.merged] {
+			t.Errorf("%s: got %+v, want the pending job %d", test.name, job, test.merged)
+			continue
+		}
+		if len(job.Triggers) != 2 || job.Triggers[1] != "second" {
+			t.Errorf("%s: got triggers %v", test.name, job.Triggers)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// leaderInfo is the value of the leader key.
+type leaderInfo struct {
+	ID  string `json:"id"`
+	URL string `json:"url,omitempty"`
+}
+
+var leadership struct {
+	sync.Mutex
+	leading bool
+}
+
+// leaderKey is the key the instances compete for.
+func leaderKey() string {
+	return stateDir() + "/leader"
+}
+
+// self is the value this instance holds the leader key with.
+func self() string {
+	b, _ := json.Marshal(leaderInfo{ID: viper.GetString("host.instance"), URL: viper.GetString("host.advertise")})
+	return string(b)
+}
+
+// isLeader tells whether this instance may write to the store, which is
+// always the case without leader election.
+func isLeader() bool {
+	if !viper.GetBool("leader.enabled") {
+		return true
+	}
+	leadership.Lock()
+	defer leadership.Unlock()
+	return leadership.leading
+}
+
+// currentLeader returns the instance holding the leader key, if any.
+func currentLeader() (*leaderInfo, error) {
+	val, ok, err := store.Get(leaderKey())
+	if err != nil || !ok {
+		return nil, err
+	}
+	info := &leaderInfo{}
+	if err := json.Unmarshal([]byte(val), info); err != nil {
+		return nil, errors.New("Couldn't read leader: " + err.Error())
+	}
+	return info, nil
+}
+
+// electionLoop competes for the leader key, refreshing it while leading. The
+// applied commits are read again when taking the lead, the previous leader
+// having moved them on.
+func electionLoop() {
+	ls, ok := store.(LeaseStore)
+	if !ok {
+		log.Fatal("Store doesn't support leader election")
+	}
+	ttl := time.Duration(viper.GetInt("leader.ttl")) * time.Second
+	for {
+		leading, err := ls.Acquire(leaderKey(), self(), ttl)
+		if err != nil {
+			log.WithError(err).Warn("Couldn't run leader election")
+			// Stop writing as the key may expire without us knowing
+			leading = false
+		}
+		leadership.Lock()
+		changed := leading != leadership.leading
+		leadership.leading = leading
+		leadership.Unlock()
+		if changed && leading {
+			log.WithField("instance", viper.GetString("host.instance")).Info("Leading")
+			for _, repo := range repos {
+				enqueueJob(repo, jobAuto, "", "leader")
+			}
+		} else if changed {
+			log.Warn("Not leading anymore")
+		}
+		time.Sleep(ttl / 3)
+	}
+}
+
+// releaseLeadership lets another instance lead right away.
+func releaseLeadership() {
+	if !viper.GetBool("leader.enabled") || !isLeader() {
+		return
+	}
+	if ls, ok := store.(LeaseStore); ok {
+		if err := ls.Release(leaderKey(), self()); err != nil {
+			log.WithError(err).Warn("Couldn't release leadership")
+		}
+	}
+}
+
+// leaderOnly serves the requests which write to the store on the leader, and
+// forwards them to it on followers, or rejects them when its URL is unknown.
+func leaderOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if isLeader() {
+			h(w, r)
+			return
+		}
+		leader, err := currentLeader()
+		if err != nil || leader == nil || leader.URL == "" {
+			http.Error(w, "Not the leader", http.StatusServiceUnavailable)
+			return
+		}
+		target, err := url.Parse(leader.URL)
+		if err != nil {
+			http.Error(w, "Couldn't parse leader URL: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.WithFields(log.Fields{
+			"path":   r.URL.Path,
+			"leader": leader.ID,
+		}).Info("Forwarding request to leader")
+		httputil.NewSingleHostReverseProxy(target).ServeHTTP(w, r)
+	}
+}
@@ -1,22 +1,14 @@
 package main
 
 import (
-	"encoding/json"
-	"flag"
-	"io/ioutil"
+	"fmt"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
-	"time"
 
 	log "github.com/Sirupsen/logrus"
-	etcd "github.com/coreos/etcd/client"
-	"github.com/google/go-github/github"
 	"github.com/spf13/viper"
-	"golang.org/x/net/context"
-	"gopkg.in/src-d/go-git.v4"
-	"gopkg.in/src-d/go-git.v4/plumbing"
-	"gopkg.in/src-d/go-git.v4/plumbing/object"
 )
 
 const (
@@ -24,45 +16,21 @@ const (
 )
 
 var (
-	flagConfigPath = flag.String("conf_dir", "", "Path to look for a config file. (directory)")
-	gitRepo        *git.Repository
-	etcdClient     etcd.KeysAPI
+	store Store
 )
 
 func main() {
-	flag.Parse()
-	setConfig(*flagConfigPath)
-	// etcd Client connection
-	if err := etcdConnect(); err != nil {
-		log.WithError(err).Fatal("Couldn't connect to etcd")
+	command, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
 	}
-
-	// Git repository opening/cloning
-	if err := openOrCloneRepo(); err != nil {
-		log.WithError(err).Fatal("Couldn't find repo or clone it")
+	run, ok := commands[command]
+	if !ok {
+		fmt.Fprintln(os.Stderr, "Unknown command "+command)
+		printUsage()
+		os.Exit(2)
 	}
-
-	go func(repo *git.Repository) {
-		syncCycle := time.Duration(viper.GetInt("repo.synccycle")) * time.Second
-		if syncCycle > 0 {
-			for {
-				select {
-				case <-time.After(syncCycle):
-					if err := syncRepo(repo); err != nil {
-						log.WithError(err).Warn("Couldn't sync automatically")
-					}
-				}
-			}
-		} else {
-			log.Info("No sync cycle")
-		}
-	}(gitRepo)
-
-	// HTTP serving
-	http.HandleFunc("/"+viper.GetString("host.hook"), hookHandler)
-	http.HandleFunc("/sync", syncHandler)
-	http.HandleFunc("/status", statusHandler)
-	log.Fatal(http.ListenAndServe(viper.GetString("host.listen")+":"+viper.GetString("host.port"), nil))
+	os.Exit(run(args))
 }
 
 func setConfig(path string) {
@@ -71,13 +39,43 @@ func setConfig(path string) {
 	viper.SetDefault("host.listen", "")
 	viper.SetDefault("host.port", "4242")
 	viper.SetDefault("host.hook", "hook")
+	viper.SetDefault("host.secret", "")
+	viper.SetDefault("host.provider", "github")
+
+	hostname, _ := os.Hostname()
+	viper.SetDefault("host.instance", hostname)
+	viper.SetDefault("host.advertise", "")
 
+	viper.SetDefault("repo.name", "")
 	viper.SetDefault("repo.path", "data/")
 	viper.SetDefault("repo.url", "https://github.com/yapo/git2etcd.git")
 	viper.SetDefault("repo.branch", "master")
+	viper.SetDefault("repo.ref", "")
+	viper.SetDefault("repo.depth", 1)
 	viper.SetDefault("repo.synccycle", 3600)
+	viper.SetDefault("repo.prune", false)
+	viper.SetDefault("repo.prunelimit", 100)
+	viper.SetDefault("repo.include", []string{})
+	viper.SetDefault("repo.exclude", []string{})
+	viper.SetDefault("repo.overlay", []string{})
 
 	viper.SetDefault("etcd.hosts", []string{"http://127.0.0.1:2379"})
+	viper.SetDefault("etcd.api", "v2")
+	viper.SetDefault("etcd.prefix", "/")
+	viper.SetDefault("etcd.v3.gateway", "")
+	viper.SetDefault("etcd.v3.maxtxnops", 128)
+	viper.SetDefault("etcd.statedir", "/_git2etcd")
+	viper.SetDefault("etcd.provenance", false)
+
+	viper.SetDefault("drift.interval", 0)
+	viper.SetDefault("drift.policy", "report")
+
+	viper.SetDefault("leader.enabled", false)
+	viper.SetDefault("leader.ttl", 15)
+
+	viper.SetDefault("watch.enabled", false)
+	viper.SetDefault("watch.retry", 5)
+	viper.SetDefault("jobs.history", 100)
 
 	// Getting config from file
 	viper.SetConfigName("config")
@@ -101,122 +99,24 @@ func setConfig(path string) {
 	log.Info("Config auth.type: ", viper.GetString("auth.type"))
 }
 
-func statusHandler(w http.ResponseWriter, r *http.Request) {
-	_, err := etcdClient.Get(context.Background(), "/", nil)
-	if err != nil && err == etcd.ErrClusterUnavailable {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-}
-
+// syncHandler queues a sync of the repo of the repo parameter, or of all of
+// them.
 func syncHandler(w http.ResponseWriter, r *http.Request) {
-	if err := syncRepo(gitRepo); err != nil {
-		http.Error(w, "Couldn't sync repo: "+err.Error(), http.StatusInternalServerError)
-	}
-}
-
-func hookHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Header.Get("X-GitHub-Event") == "ping" {
-		log.Info("Ping received")
-	} else if r.Header.Get("X-GitHub-Event") == "push" {
-		treatPushEvent(w, r)
-	} else {
-		// handle other events than push.
-	}
-}
-
-func treatPushEvent(w http.ResponseWriter, r *http.Request) {
-	var event github.PushEvent
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		log.WithError(err).Error("Couldn't read request body")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	if err = json.Unmarshal(body, &event); err != nil {
-		log.WithError(err).Error("Couldn't Unmarshal json payload")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	log.Info("Push received from ", *event.Repo.FullName)
-	added := make(map[string]bool)
-	modified := make(map[string]bool)
-	removed := make(map[string]bool)
-	for _, commit := range event.Commits {
-		for _, ca := range commit.Added {
-			added[ca] = true
-		}
-		for _, cm := range commit.Modified {
-			modified[cm] = true
+	selected := repos
+	if name := r.URL.Query().Get("repo"); name != "" {
+		repo, ok := requestRepo(w, r)
+		if !ok {
+			return
 		}
-		for _, cr := range commit.Removed {
-			removed[cr] = true
-		}
-	}
-	wt, err := gitRepo.Worktree()
-	if err != nil {
-		log.WithError(err).Error("Couldn't get repo's WorkTree")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		selected = []*syncedRepo{repo}
 	}
-	if err = wt.Pull(nil); err != nil {
-		log.WithError(err).Error("Couldn't pull repo's HEAD")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	kind := jobSync
+	if full, _ := strconv.ParseBool(r.URL.Query().Get("full")); full {
+		kind = jobFull
 	}
-	log.Info("Repository head is now ", *event.After)
-	commit, err := gitRepo.CommitObject(plumbing.NewHash(*event.After))
-	if err != nil {
-		log.WithError(err).Error("Couldn't get HEAD's commit")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	tree, err := commit.Tree()
-	if err != nil {
-		log.WithError(err).Error("Couldn't get HEAD's tree")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	treatAdded(added, tree)
-	treatModified(modified, tree)
-	treatRemoved(removed, tree)
-}
-
-func treatAdded(added map[string]bool, tree *object.Tree) {
-	for file := range added {
-		_, err := tree.File(file)
-		if err != nil {
-			log.WithError(err).Warn("Couldn't get file: ", file)
-			continue
-		}
-		if err := etcdCreate(file); err != nil {
-			log.WithError(err).Warn("Couldn't create key")
-		}
-	}
-}
-
-func treatModified(modified map[string]bool, tree *object.Tree) {
-	for file := range modified {
-		_, err := tree.File(file)
-		if err != nil {
-			log.WithError(err).Warn("Couldn't get file: ", file)
-			continue
-		}
-		if err := etcdSet(file); err != nil {
-			log.WithError(err).Warn("Couldn't set key")
-		}
-	}
-}
-
-func treatRemoved(removed map[string]bool, tree *object.Tree) {
-	for file := range removed {
-		_, err := tree.File(file)
-		if err != nil {
-			log.WithError(err).Warn("Couldn't get file: ", file)
-			continue
-		}
-		if err := etcdDelete(file); err != nil {
-			log.WithError(err).Warn("Couldn't delete key")
-		}
+	queued := []*syncJob{}
+	for _, repo := range selected {
+		queued = append(queued, enqueueJob(repo, kind, "", "api"))
 	}
+	waitJobs(w, r, queued)
 }
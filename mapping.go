@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"path"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// mappingRule stores the files under Dir, or matching Glob, under Prefix
+// rather than under their own path.
+type mappingRule struct {
+	Dir      string
+	Glob     string
+	Prefix   string
+	StripExt bool
+}
+
+var mappingRules []mappingRule
+
+func loadMappingRules() error {
+	rules := []mappingRule{}
+	if err := viper.UnmarshalKey("mapping", &rules); err != nil {
+		return errors.New("Couldn't read mapping rules: " + err.Error())
+	}
+	for i, rule := range rules {
+		if (rule.Dir == "") == (rule.Glob == "") {
+			return errors.New("Mapping rules need either a dir or a glob")
+		}
+		if _, err := path.Match(rule.Glob, ""); err != nil {
+			return errors.New("Invalid mapping glob " + rule.Glob + ": " + err.Error())
+		}
+		rules[i].Dir = strings.Trim(rule.Dir, "/")
+	}
+	mappingRules = rules
+	return nil
+}
+
+// etcdKey gives the key a file of a repository synced under prefix is stored
+// at, using the first mapping rule matching it.
+func etcdKey(prefix, file string) string {
+	file = strings.Trim(file, "/")
+	for _, rule := range mappingRules {
+		rel, ok := rule.match(file)
+		if !ok {
+			continue
+		}
+		if rule.StripExt {
+			rel = strings.TrimSuffix(rel, path.Ext(rel))
+		}
+		return path.Join(prefix, rule.Prefix, rel)
+	}
+	return path.Join(prefix, file)
+}
+
+// keyFile returns the file of the repository that would be stored at key, the
+// inverse of etcdKey. Extensions stripped by a directory rule can't be known
+// and are left out.
+func keyFile(prefix, key string) (string, bool) {
+	candidates := []string{}
+	for _, rule := range mappingRules {
+		dir := path.Join(prefix, rule.Prefix)
+		if key == dir || !underPrefix(key, dir) {
+			continue
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(key, dir), "/")
+		if rule.Dir != "" {
+			candidates = append(candidates, rule.Dir+"/"+rel)
+			continue
+		}
+		if rule.StripExt {
+			rel += path.Ext(rule.Glob)
+		}
+		candidates = append(candidates, globDir(rule.Glob)+rel)
+	}
+	if key != prefix && underPrefix(key, prefix) {
+		candidates = append(candidates, strings.TrimPrefix(strings.TrimPrefix(key, prefix), "/"))
+	}
+	for _, file := range candidates {
+		if etcdKey(prefix, file) == key {
+			return file, true
+		}
+	}
+	return "", false
+}
+
+// match returns the path of file relative to the directory of the rule.
+func (rule mappingRule) match(file string) (string, bool) {
+	if rule.Dir != "" {
+		if !strings.HasPrefix(file, rule.Dir+"/") {
+			return "", false
+		}
+		return strings.TrimPrefix(file, rule.Dir+"/"), true
+	}
+	if ok, _ := path.Match(rule.Glob, file); !ok {
+		return "", false
+	}
+	return strings.TrimPrefix(file, globDir(rule.Glob)), true
+}
+
+// globDir returns the leading directories of glob without any pattern.
+func globDir(glob string) string {
+	i := strings.IndexAny(glob, "*?[\\")
+	if i < 0 {
+		i = len(glob)
+	}
+	return glob[:strings.LastIndex(glob[:i], "/")+1]
+}
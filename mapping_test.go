@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestEtcdKey(t *testing.T) {
+	mappingRules = []mappingRule{
+		{Dir: "services", Prefix: "svc"},
+		{Dir: "env", Prefix: "e", StripExt: true},
+		{Glob: "conf/*.json", Prefix: "cfg", StripExt: true},
+	}
+	defer func() { mappingRules = nil }()
+	tests := []struct {
+		file string
+		key  string
+		// back is the file keyFile gives for key, if not file
+		back string
+	}{
+		{file: "app/key", key: "/p/app/key"},
+		{file: "/app/key/", key: "/p/app/key", back: "app/key"},
+		{file: "services/a/b", key: "/p/svc/a/b"},
+		{file: "conf/app.json", key: "/p/cfg/app"},
+		{file: "conf/sub/app.json", key: "/p/conf/sub/app.json"},
+		{file: "conf/app.yml", key: "/p/conf/app.yml"},
+		// Extensions stripped by a directory rule can't be known
+		{file: "env/prod.txt", key: "/p/e/prod", back: "env/prod"},
+	}
+	for _, test := range tests {
+		if key := etcdKey("/p", test.file); key != test.key {
+			t.Errorf("etcdKey(%q) = %q, want %q", test.file, key, test.key)
+			continue
+		}
+		back := test.back
+		if back == "" {
+			back = test.file
+		}
+		if file, ok := keyFile("/p", test.key); !ok || file != back {
+			t.Errorf("keyFile(%q) = %q, %v, want %q", test.key, file, ok, back)
+		}
+	}
+}
+
+func TestKeyFileOutsidePrefix(t *testing.T) {
+	for _, key := range []string{"/p", "/other/key", "/pp/key"} {
+		if file, ok := keyFile("/p", key); ok {
+			t.Errorf("keyFile(%q) = %q, want none", key, file)
+		}
+	}
+}
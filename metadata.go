@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	gitobj "gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// metaDir is where the metadata of the applied commit of repo is kept.
+func metaDir(repo *syncedRepo) string {
+	return stateDir() + "/" + repo.Name
+}
+
+// provenance tells where the value of a key comes from.
+type provenance struct {
+	Commit string `json:"commit"`
+	File   string `json:"file"`
+}
+
+// metadataOps returns the operations recording commit as applied, along with
+// the provenance of the keys ops set when enabled. The commit key comes last
+// so it is only written once everything else was.
+func metadataOps(repo *syncedRepo, ops []storeOp, commit *gitobj.Commit) []storeOp {
+	meta := []storeOp{}
+	if viper.GetBool("etcd.provenance") {
+		for _, op := range ops {
+			key := metaDir(repo) + "/keys" + op.Key
+			if op.Type == opDelete {
+				meta = append(meta, storeOp{Type: opDelete, Key: key})
+				continue
+			}
+			val, _ := json.Marshal(provenance{Commit: commit.Hash.String(), File: op.File})
+			meta = append(meta, storeOp{Type: opSet, Key: key, Value: string(val)})
+		}
+	}
+	info := map[string]string{
+		"author":   commit.Author.Name + " <" + commit.Author.Email + ">",
+		"message":  strings.TrimSpace(commit.Message),
+		"time":     time.Now().UTC().Format(time.RFC3339),
+		"instance": viper.GetString("host.instance"),
+	}
+	for _, key := range sortedKeys(info) {
+		meta = append(meta, storeOp{Type: opSet, Key: metaDir(repo) + "/" + key, Value: info[key]})
+	}
+	meta = append(meta, storeOp{Type: opSet, Key: metaDir(repo) + "/config", Value: syncConfig(repo)})
+	return append(meta, storeOp{Type: opSet, Key: metaDir(repo) + "/commit", Value: commit.Hash.String()})
+}
+
+// syncConfig renders the settings deciding which keys the files of repo are
+// stored as, a commit applied with other ones having to be synced in full.
+func syncConfig(repo *syncedRepo) string {
+	b, _ := json.Marshal(struct {
+		Prefix  string        `json:"prefix"`
+		Overlay []string      `json:"overlay"`
+		Include []string      `json:"include"`
+		Exclude []string      `json:"exclude"`
+		Mapping []mappingRule `json:"mapping"`
+		Parse   []parseRule   `json:"parse"`
+	}{
+		Prefix:  repo.Prefix,
+		Overlay: repo.Overlay,
+		Include: viper.GetStringSlice("repo.include"),
+		Exclude: viper.GetStringSlice("repo.exclude"),
+		Mapping: mappingRules,
+		Parse:   parseRules,
+	})
+	return string(b)
+}
+
+// loadAppliedCommit resumes from the commit recorded in the store, as long as
+// the local clone knows it and it was applied with the same sync config. A
+// full sync follows otherwise.
+func loadAppliedCommit(repo *syncedRepo) error {
+	val, ok, err := store.Get(metaDir(repo) + "/commit")
+	if err != nil {
+		return errors.New("Couldn't get applied commit: " + err.Error())
+	}
+	hash := plumbing.ZeroHash
+	if ok {
+		hash = plumbing.NewHash(val)
+	}
+	if hash == repo.appliedCommit {
+		return nil
+	}
+	if !ok {
+		log.Info("No applied commit recorded")
+		repo.appliedCommit = hash
+		return nil
+	}
+	config, _, err := store.Get(metaDir(repo) + "/config")
+	if err != nil {
+		return errors.New("Couldn't get sync config of applied commit: " + err.Error())
+	}
+	if config != syncConfig(repo) {
+		log.WithFields(log.Fields{
+			"commit":   val,
+			"previous": config,
+		}).Warn("Sync config changed since the applied commit, doing a full sync")
+		hash = plumbing.ZeroHash
+	} else if _, err := repo.git.CommitObject(hash); err != nil {
+		log.WithError(err).WithField("commit", val).Warn("Applied commit isn't in the clone, doing a full sync")
+		hash = plumbing.ZeroHash
+	} else {
+		log.WithField("commit", val).Info("Resuming from applied commit")
+	}
+	repo.appliedCommit = hash
+	return nil
+}
+
+// loadSyncState reads the applied and pinned commits of repo from the store,
+// which the rollback command or another instance may have changed.
+func loadSyncState(repo *syncedRepo) error {
+	if err := loadAppliedCommit(repo); err != nil {
+		return err
+	}
+	return loadPinnedCommit(repo)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricBuckets are the upper bounds in seconds of the duration histograms.
+var metricBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+type metricDesc struct {
+	kind string
+	help string
+}
+
+var metricDescs = map[string]metricDesc{
+	"git2etcd_syncs_total":                    {"counter", "Sync jobs run, by repo, first trigger and result."},
+	"git2etcd_sync_duration_seconds":          {"histogram", "Duration of the sync jobs, by repo and first trigger."},
+	"git2etcd_keys_total":                     {"counter", "Keys written, by repo and operation."},
+	"git2etcd_keys_failed_total":              {"counter", "Keys that couldn't be written, by repo and operation."},
+	"git2etcd_last_success_timestamp_seconds": {"gauge", "Time of the last successful sync job of each repo."},
+	"git2etcd_applied_commit":                 {"gauge", "Commit applied to etcd for each repo, always 1."},
+	"git2etcd_git_pull_duration_seconds":      {"histogram", "Duration of the pulls and fetches, by repo and result."},
+	"git2etcd_etcd_request_duration_seconds":  {"histogram", "Duration of the etcd requests, by operation and result."},
+	"git2etcd_webhook_deliveries_total":       {"counter", "Webhook deliveries, by provider and outcome."},
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+var metrics struct {
+	sync.Mutex
+	// values holds the counters and gauges by name, then by labels
+	values     map[string]map[string]float64
+	histograms map[string]map[string]*histogram
+}
+
+// labelEscaper escapes what the Prometheus text format allows in label values.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricLabels renders pairs of label names and values.
+func metricLabels(pairs ...string) string {
+	labels := []string{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		labels = append(labels, pairs[i]+`="`+labelEscaper.Replace(pairs[i+1])+`"`)
+	}
+	return strings.Join(labels, ",")
+}
+
+func addMetric(name, labels string, v float64) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	if metrics.values == nil {
+		metrics.values = map[string]map[string]float64{}
+	}
+	if metrics.values[name] == nil {
+		metrics.values[name] = map[string]float64{}
+	}
+	metrics.values[name][labels] += v
+}
+
+// setMetric sets a gauge, dropping the other series starting with the same
+// first label.
+func setMetric(name, labels string, v float64) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	if metrics.values == nil {
+		metrics.values = map[string]map[string]float64{}
+	}
+	if metrics.values[name] == nil {
+		metrics.values[name] = map[string]float64{}
+	}
+	first := strings.SplitN(labels, ",", 2)[0]
+	for series := range metrics.values[name] {
+		if strings.SplitN(series, ",", 2)[0] == first {
+			delete(metrics.values[name], series)
+		}
+	}
+	metrics.values[name][labels] = v
+}
+
+// observeSince records the time elapsed since start in a histogram.
+func observeSince(name, labels string, start time.Time) {
+	seconds := time.Since(start).Seconds()
+	metrics.Lock()
+	defer metrics.Unlock()
+	if metrics.histograms == nil {
+		metrics.histograms = map[string]map[string]*histogram{}
+	}
+	if metrics.histograms[name] == nil {
+		metrics.histograms[name] = map[string]*histogram{}
+	}
+	h, ok := metrics.histograms[name][labels]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(metricBuckets))}
+		metrics.histograms[name][labels] = h
+	}
+	for i, bound := range metricBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// observeEtcd records the duration of an etcd request, to be deferred with
+// the address of its error.
+func observeEtcd(op string, start time.Time, err *error) {
+	observeSince("git2etcd_etcd_request_duration_seconds", metricLabels("op", op, "result", metricResult(*err)), start)
+}
+
+// countKeys counts the keys a sync of repo wrote and failed to.
+func countKeys(repo *syncedRepo, results []keyResult) {
+	for _, result := range results {
+		name := "git2etcd_keys_total"
+		if result.Error != "" {
+			name = "git2etcd_keys_failed_total"
+		}
+		addMetric(name, metricLabels("repo", repo.Name, "op", result.Op), 1)
+	}
+}
+
+func metricResult(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+// metricsHandler serves the metrics in the Prometheus text format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var b bytes.Buffer
+	writeMetrics(&b)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	b.WriteTo(w)
+}
+
+// writeMetrics renders the metrics to w, which mustn't block as the metrics
+// are locked meanwhile.
+func writeMetrics(w io.Writer) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	names := []string{}
+	for name := range metricDescs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		desc := metricDescs[name]
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, desc.help, name, desc.kind)
+		if desc.kind == "histogram" {
+			for _, labels := range sortedSeries(metrics.histograms[name]) {
+				h := metrics.histograms[name][labels]
+				for i, bound := range metricBuckets {
+					fmt.Fprintf(w, "%s_bucket{%s} %d\n", name, joinLabels(labels, metricLabels("le", strconv.FormatFloat(bound, 'g', -1, 64))), h.counts[i])
+				}
+				fmt.Fprintf(w, "%s_bucket{%s} %d\n", name, joinLabels(labels, `le="+Inf"`), h.count)
+				fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, h.sum)
+				fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+			}
+			continue
+		}
+		series := []string{}
+		for labels := range metrics.values[name] {
+			series = append(series, labels)
+		}
+		sort.Strings(series)
+		for _, labels := range series {
+			fmt.Fprintf(w, "%s{%s} %g\n", name, labels, metrics.values[name][labels])
+		}
+	}
+}
+
+func sortedSeries(histograms map[string]*histogram) []string {
+	series := []string{}
+	for labels := range histograms {
+		series = append(series, labels)
+	}
+	sort.Strings(series)
+	return series
+}
+
+func joinLabels(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestMetricLabels(t *testing.T) {
+	tests := []struct {
+		pairs []string
+		want  string
+	}{
+		{[]string{"repo", "config"}, `repo="config"`},
+		{[]string{"repo", "config", "op", "set"}, `repo="config",op="set"`},
+		{[]string{"repo", `a\b "c"`}, `repo="a\\b \"c\""`},
+		{[]string{"repo", "a\nb\tc"}, "repo=\"a\\nb\tc\""},
+		{[]string{"repo", "é"}, `repo="é"`},
+	}
+	for _, test := range tests {
+		if got := metricLabels(test.pairs...); got != test.want {
+			t.Errorf("metricLabels(%q) = %s, want %s", test.pairs, got, test.want)
+		}
+	}
+}
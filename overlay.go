@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	gitobj "gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// tombstoneExt marks a file of an overlay layer deleting the path it names,
+// file or directory, from the layers below.
+const tombstoneExt = ".tombstone"
+
+// treeFile is a file of a tree along with the path it is synced as, which is
+// its path within its layer when overlaying.
+type treeFile struct {
+	*gitobj.File
+	Path  string
+	Layer string
+	layer int
+}
+
+// syncedFiles returns the files of tree repo syncs, sorted by path, followed
+// by the ones ignored by the filters. When overlaying, only the files under a
+// layer are synced, each path coming from the last layer that has it unless a
+// later layer holds its tombstone.
+func syncedFiles(repo *syncedRepo, tree *gitobj.Tree) ([]treeFile, []treeFile, error) {
+	filter, err := newFileFilter(tree)
+	if err != nil {
+		return nil, nil, err
+	}
+	top := map[string]treeFile{}
+	tombstones := map[string]int{}
+	ignored := []treeFile{}
+	err = tree.Files().ForEach(func(f *gitobj.File) error {
+		file := treeFile{File: f, Path: f.Name}
+		if len(repo.Overlay) > 0 {
+			if file.layer = overlayLayer(repo.Overlay, f.Name); file.layer < 0 {
+				return nil
+			}
+			file.Layer = repo.Overlay[file.layer]
+			file.Path = strings.TrimPrefix(f.Name, file.Layer+"/")
+			if strings.HasSuffix(file.Path, tombstoneExt) {
+				path := strings.TrimSuffix(file.Path, tombstoneExt)
+				if layer, ok := tombstones[path]; !ok || file.layer > layer {
+					tombstones[path] = file.layer
+				}
+				return nil
+			}
+		}
+		if !filter.synced(f.Name) {
+			ignored = append(ignored, file)
+			return nil
+		}
+		if other, ok := top[file.Path]; !ok || file.layer > other.layer {
+			top[file.Path] = file
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, errors.New("Couldn't walk in files: " + err.Error())
+	}
+	paths := []string{}
+	for path, file := range top {
+		if tombstone, ok := tombstoned(tombstones, path, file.layer); ok {
+			log.WithFields(log.Fields{
+				"name":      file.Name,
+				"tombstone": tombstone,
+			}).Debug("File deleted by a tombstone")
+			continue
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	synced := []treeFile{}
+	for _, path := range paths {
+		synced = append(synced, top[path])
+	}
+	return synced, ignored, nil
+}
+
+// overlayLayer returns the index of the layer name is in, -1 if none.
+func overlayLayer(layers []string, name string) int {
+	for i, layer := range layers {
+		if strings.HasPrefix(name, layer+"/") {
+			return i
+		}
+	}
+	return -1
+}
+
+// tombstoned returns the tombstone of a layer above layer deleting path, if
+// any.
+func tombstoned(tombstones map[string]int, path string, layer int) (string, bool) {
+	for tombstone, tombstoneLayer := range tombstones {
+		if tombstoneLayer > layer && (path == tombstone || strings.HasPrefix(path, tombstone+"/")) {
+			return tombstone + tombstoneExt, true
+		}
+	}
+	return "", false
+}
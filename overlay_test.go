@@ -0,0 +1,73 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSyncedFiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		overlay []string
+		files   map[string]string
+		// want holds the file each synced path comes from
+		want map[string]string
+	}{
+		{
+			name:  "no overlay",
+			files: map[string]string{"a": "1", "dir/b": "2"},
+			want:  map[string]string{"a": "a", "dir/b": "dir/b"},
+		},
+		{
+			name:    "upper layer wins",
+			overlay: []string{"base", "prod"},
+			files:   map[string]string{"base/a": "1", "base/b": "2", "prod/a": "3", "other/c": "4"},
+			want:    map[string]string{"a": "prod/a", "b": "base/b"},
+		},
+		{
+			name:    "tombstones of files and directories",
+			overlay: []string{"base", "prod"},
+			files: map[string]string{
+				"base/a":               "1",
+				"base/b":               "2",
+				"base/dir/c":           "3",
+				"base/dirx":            "4",
+				"prod/b.tombstone":     "",
+				"prod/dir.tombstone":   "",
+				"prod/other.tombstone": "",
+			},
+			want: map[string]string{"a": "base/a", "dirx": "base/dirx"},
+		},
+		{
+			name:    "tombstone below the file",
+			overlay: []string{"base", "prod"},
+			files:   map[string]string{"base/a.tombstone": "", "prod/a": "1"},
+			want:    map[string]string{"a": "prod/a"},
+		},
+		{
+			name:    "tombstone in the same layer",
+			overlay: []string{"base", "prod"},
+			files:   map[string]string{"prod/a.tombstone": "", "prod/a": "1"},
+			want:    map[string]string{"a": "prod/a"},
+		},
+	}
+	for _, test := range tests {
+		r := newTestRepo(t)
+		tree, err := testCommit(t, r, test.files).Tree()
+		if err != nil {
+			t.Fatal(err)
+		}
+		synced, _, err := syncedFiles(&syncedRepo{Overlay: test.overlay}, tree)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		got := map[string]string{}
+		for _, f := range synced {
+			got[f.Path] = f.Name
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
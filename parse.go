@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/magiconair/properties"
+	toml "github.com/pelletier/go-toml"
+	"github.com/spf13/viper"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// parseRule expands the files matching Glob into one key per leaf value,
+// rather than storing them as a single key.
+type parseRule struct {
+	Glob string
+	// Format is json, yaml, toml or properties, guessed from the extension if empty
+	Format string
+	// Arrays is index to store each element under its index, or json to store
+	// the whole array as a JSON value
+	Arrays string
+	// KeepExt keeps the file extension in the key name
+	KeepExt bool
+}
+
+var parseRules []parseRule
+
+func loadParseRules() error {
+	rules := []parseRule{}
+	if err := viper.UnmarshalKey("parse", &rules); err != nil {
+		return errors.New("Couldn't read parse rules: " + err.Error())
+	}
+	for i, rule := range rules {
+		if _, err := path.Match(rule.Glob, ""); err != nil {
+			return errors.New("Invalid parse glob " + rule.Glob + ": " + err.Error())
+		}
+		switch rule.Format {
+		case "", "json", "yaml", "toml", "properties":
+		default:
+			return errors.New("Unknown parse format " + rule.Format)
+		}
+		switch rule.Arrays {
+		case "":
+			rules[i].Arrays = "index"
+		case "index", "json":
+		default:
+			return errors.New("Unknown arrays handling " + rule.Arrays)
+		}
+	}
+	parseRules = rules
+	return nil
+}
+
+// matchParseRule returns the rule of the first glob matching name, either on
+// the full path or on the base name for globs without any slash.
+func matchParseRule(name string) *parseRule {
+	for i, rule := range parseRules {
+		target := name
+		if !strings.Contains(rule.Glob, "/") {
+			target = path.Base(name)
+		}
+		if ok, _ := path.Match(rule.Glob, target); ok {
+			return &parseRules[i]
+		}
+	}
+	return nil
+}
+
+// fileKeys returns the keys and values a file of the repository synced under
+// prefix is stored as.
+func fileKeys(prefix, name, content string) (map[string]string, error) {
+	rule := matchParseRule(name)
+	if rule == nil {
+		// TrimSpace is used mostly to remove trailing newlines from Git files
+		return map[string]string{etcdKey(prefix, name): strings.TrimSpace(content)}, nil
+	}
+	ext := path.Ext(name)
+	format := rule.Format
+	if format == "" {
+		format = formatFromExt(ext)
+	}
+	data, err := parseContent(format, content)
+	if err != nil {
+		return nil, errors.New("Couldn't parse " + name + " as " + format + ": " + err.Error())
+	}
+	root := etcdKey(prefix, name)
+	if !rule.KeepExt {
+		root = strings.TrimSuffix(root, ext)
+	}
+	kvs := map[string]string{}
+	if err := flatten(root, data, rule.Arrays, kvs); err != nil {
+		return nil, errors.New("Couldn't flatten " + name + ": " + err.Error())
+	}
+	return kvs, nil
+}
+
+func formatFromExt(ext string) string {
+	switch ext {
+	case ".yml", ".yaml":
+		return "yaml"
+	case ".toml":
+		return "toml"
+	case ".properties":
+		return "properties"
+	}
+	return "json"
+}
+
+func parseContent(format, content string) (interface{}, error) {
+	switch format {
+	case "yaml":
+		var data interface{}
+		if err := yaml.Unmarshal([]byte(content), &data); err != nil {
+			return nil, err
+		}
+		return normalize(data), nil
+	case "toml":
+		tree, err := toml.Load(content)
+		if err != nil {
+			return nil, err
+		}
+		return normalize(tree.ToMap()), nil
+	case "properties":
+		props, err := properties.LoadString(content)
+		if err != nil {
+			return nil, err
+		}
+		// Dotted property names are nested like the other formats
+		data := map[string]interface{}{}
+		for _, key := range props.Keys() {
+			val, _ := props.Get(key)
+			data[strings.Replace(key, ".", "/", -1)] = val
+		}
+		return data, nil
+	}
+	var data interface{}
+	dec := json.NewDecoder(strings.NewReader(content))
+	dec.UseNumber()
+	if err := dec.Decode(&data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// normalize converts the maps and slices decoders give to
+// map[string]interface{} and []interface{} so they can be walked and encoded
+// to JSON.
+func normalize(data interface{}) interface{} {
+	switch v := data.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for key, val := range v {
+			m[fmt.Sprint(key)] = normalize(val)
+		}
+		return m
+	case map[string]interface{}:
+		m := map[string]interface{}{}
+		for key, val := range v {
+			m[key] = normalize(val)
+		}
+		return m
+	case []map[string]interface{}:
+		s := []interface{}{}
+		for _, val := range v {
+			s = append(s, normalize(val))
+		}
+		return s
+	case []interface{}:
+		s := []interface{}{}
+		for _, val := range v {
+			s = append(s, normalize(val))
+		}
+		return s
+	}
+	return data
+}
+
+func flatten(prefix string, data interface{}, arrays string, kvs map[string]string) error {
+	switch v := data.(type) {
+	case map[string]interface{}:
+		keys := []string{}
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if err := flatten(prefix+"/"+strings.Trim(key, "/"), v[key], arrays, kvs); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if arrays == "json" {
+			b, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			kvs[prefix] = string(b)
+			return nil
+		}
+		for i, val := range v {
+			if err := flatten(fmt.Sprintf("%s/%d", prefix, i), val, arrays, kvs); err != nil {
+				return err
+			}
+		}
+	case nil:
+		kvs[prefix] = ""
+	default:
+		kvs[prefix] = fmt.Sprint(v)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseContent(t *testing.T) {
+	tests := []struct {
+		format  string
+		content string
+		arrays  string
+		want    map[string]string
+		err     bool
+	}{
+		{
+			format:  "json",
+			content: `{"db": {"host": "a", "port": 5432, "ratio": 1.50}, "debug": true, "empty": null}`,
+			want: map[string]string{
+				"/r/db/host":  "a",
+				"/r/db/port":  "5432",
+				"/r/db/ratio": "1.50",
+				"/r/debug":    "true",
+				"/r/empty":    "",
+			},
+		},
+		{
+			format:  "json",
+			content: `{"hosts": ["a", {"name": "b"}]}`,
+			arrays:  "index",
+			want:    map[string]string{"/r/hosts/0": "a", "/r/hosts/1/name": "b"},
+		},
+		{
+			format:  "json",
+			content: `{"hosts": ["a", "b"]}`,
+			arrays:  "json",
+			want:    map[string]string{"/r/hosts": `["a","b"]`},
+		},
+		{
+			format:  "yaml",
+			content: "db:\n  host: a\n  1: one\nlist:\n  - x\n",
+			want:    map[string]string{"/r/db/host": "a", "/r/db/1": "one", "/r/list/0": "x"},
+		},
+		{
+			format:  "toml",
+			content: "[db]\nhost = \"a\"\nport = 5432\n",
+			want:    map[string]string{"/r/db/host": "a", "/r/db/port": "5432"},
+		},
+		{
+			format:  "properties",
+			content: "db.host = a\ndebug = true\n",
+			want:    map[string]string{"/r/db/host": "a", "/r/debug": "true"},
+		},
+		{format: "json", content: `{"db": `, err: true},
+		{format: "yaml", content: "db: [a\n", err: true},
+		{format: "toml", content: "[db\n", err: true},
+	}
+	for _, test := range tests {
+		data, err := parseContent(test.format, test.content)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s %q: want an error", test.format, test.content)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %q: %s", test.format, test.content, err)
+			continue
+		}
+		arrays := test.arrays
+		if arrays == "" {
+			arrays = "index"
+		}
+		got := map[string]string{}
+		if err := flatten("/r", data, arrays, got); err != nil {
+			t.Errorf("%s %q: %s", test.format, test.content, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s %q: got %v, want %v", test.format, test.content, got, test.want)
+		}
+	}
+}
+
+func TestFileKeys(t *testing.T) {
+	parseRules = []parseRule{
+		{Glob: "*.y*ml", Arrays: "index"},
+		{Glob: "conf/*.json", Arrays: "index", KeepExt: true},
+	}
+	defer func() { parseRules = nil }()
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+	}{
+		{"app/key", "value\n", map[string]string{"/p/app/key": "value"}},
+		{"svc.yml", "port: 80\n", map[string]string{"/p/svc/port": "80"}},
+		{"app/svc.yaml", "port: 80\n", map[string]string{"/p/app/svc/port": "80"}},
+		{"conf/app.json", `{"port": 80}`, map[string]string{"/p/conf/app.json/port": "80"}},
+		{"app.json", `{"port": 80}`, map[string]string{"/p/app.json": `{"port": 80}`}},
+	}
+	for _, test := range tests {
+		got, err := fileKeys("/p", test.name, test.content)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// syncPlan is what a sync of a commit would change in the store.
+type syncPlan struct {
+	Commit    string       `json:"commit"`
+	Creates   []planChange `json:"creates"`
+	Updates   []planChange `json:"updates"`
+	Deletes   []planChange `json:"deletes"`
+	Unchanged []planChange `json:"unchanged"`
+}
+
+type planChange struct {
+	Key  string `json:"key"`
+	File string `json:"file,omitempty"`
+	// Layer is the overlay layer the new value comes from
+	Layer string `json:"layer,omitempty"`
+	Old   string `json:"old,omitempty"`
+	New   string `json:"new,omitempty"`
+}
+
+// planRepo fetches the repo, and sorts the operations a sync of its fetched
+// head would run by their effect on the store, without writing anything nor
+// touching the worktree.
+func planRepo(repo *syncedRepo) (*syncPlan, error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	if err := loadAppliedCommit(repo); err != nil {
+		return nil, err
+	}
+	if err := fetchRepo(repo); err != nil {
+		return nil, err
+	}
+	commit, err := fetchedHead(repo)
+	if err != nil {
+		return nil, err
+	}
+	ops, err := commitOps(repo, commit, false)
+	if err != nil {
+		return nil, err
+	}
+	current, err := store.List(repo.Prefix)
+	if err != nil {
+		return nil, errors.New("Couldn't list current keys: " + err.Error())
+	}
+	plan := &syncPlan{
+		Commit:    commit.Hash.String(),
+		Creates:   []planChange{},
+		Updates:   []planChange{},
+		Deletes:   []planChange{},
+		Unchanged: []planChange{},
+	}
+	for _, op := range ops {
+		change := planChange{Key: op.Key, File: op.File}
+		if layer := overlayLayer(repo.Overlay, op.File); layer >= 0 {
+			change.Layer = repo.Overlay[layer]
+		}
+		old, ok := current[op.Key]
+		switch {
+		case op.Type == opDelete && ok:
+			change.Old = old
+			plan.Deletes = append(plan.Deletes, change)
+		case op.Type == opDelete:
+		case !ok:
+			change.New = op.Value
+			plan.Creates = append(plan.Creates, change)
+		case old != op.Value:
+			change.Old, change.New = old, op.Value
+			plan.Updates = append(plan.Updates, change)
+		default:
+			change.New = op.Value
+			plan.Unchanged = append(plan.Unchanged, change)
+		}
+	}
+	return plan, nil
+}
+
+func (p *syncPlan) write(w io.Writer, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(p)
+	case "text":
+		fmt.Fprintf(w, "Plan for commit %s\n", p.Commit)
+		for _, section := range []struct {
+			sign    string
+			changes []planChange
+		}{{"+", p.Creates}, {"~", p.Updates}, {"-", p.Deletes}} {
+			for _, change := range section.changes {
+				if change.File != "" {
+					fmt.Fprintf(w, "  %s %s (%s)\n", section.sign, change.Key, change.File)
+				} else {
+					fmt.Fprintf(w, "  %s %s\n", section.sign, change.Key)
+				}
+			}
+		}
+		_, err := fmt.Fprintf(w, "%d to create, %d to update, %d to delete, %d unchanged\n",
+			len(p.Creates), len(p.Updates), len(p.Deletes), len(p.Unchanged))
+		return err
+	}
+	return errors.New("Unknown plan format " + format)
+}
+
+func planHandler(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "text"
+	}
+	if format != "text" && format != "json" {
+		http.Error(w, "Unknown plan format "+format, http.StatusBadRequest)
+		return
+	}
+	repo, ok := requestRepo(w, r)
+	if !ok {
+		return
+	}
+	plan, err := planRepo(repo)
+	if err != nil {
+		http.Error(w, "Couldn't plan sync: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	plan.write(w, format)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-semver/semver"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	gitobj "gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// refKind is what repo.ref designates.
+type refKind int
+
+const (
+	refBranch refKind = iota
+	refTag
+	refTagPattern
+	refCommit
+)
+
+var commitPattern = regexp.MustCompile("^[0-9a-f]{40}$")
+
+// trackedRef returns what repo.ref designates along with its name: the branch,
+// tag, tag pattern or commit hash. repo.branch is tracked when repo.ref is
+// empty.
+func trackedRef(repo *syncedRepo) (refKind, string) {
+	ref := repo.Ref
+	switch {
+	case ref == "":
+		return refBranch, repo.Branch
+	case strings.HasPrefix(ref, "refs/heads/"):
+		return refBranch, strings.TrimPrefix(ref, "refs/heads/")
+	case commitPattern.MatchString(ref):
+		return refCommit, ref
+	case strings.Contains(ref, "*"):
+		return refTagPattern, strings.TrimPrefix(ref, "refs/tags/")
+	}
+	return refTag, strings.TrimPrefix(ref, "refs/tags/")
+}
+
+// tracksRef tells whether a push to ref may change the commit to sync.
+func tracksRef(repo *syncedRepo, ref string) bool {
+	kind, name := trackedRef(repo)
+	switch kind {
+	case refBranch:
+		return ref == "refs/heads/"+name
+	case refTag:
+		return ref == "refs/tags/"+name
+	case refTagPattern:
+		ok, _ := path.Match(name, strings.TrimPrefix(ref, "refs/tags/"))
+		return ok && strings.HasPrefix(ref, "refs/tags/")
+	}
+	return false
+}
+
+// fetchRepo fetches the branch and every tag, for repo.ref to be resolved.
+func fetchRepo(repo *syncedRepo) error {
+	fo := &git.FetchOptions{Tags: git.AllTags, Force: true}
+	var err error
+	fo.Auth, err = getGitAuth(repo.Auth)
+	if err != nil {
+		return err
+	}
+	if err := repo.git.Fetch(fo); err != nil && err != git.NoErrAlreadyUpToDate {
+		return errors.New("Couldn't fetch: " + err.Error())
+	}
+	return nil
+}
+
+// resolveRef returns the commit repo.ref designates when it isn't a branch,
+// and checks it out.
+func resolveRef(repo *syncedRepo) (*gitobj.Commit, error) {
+	commit, err := lookupRef(repo)
+	if err != nil {
+		return nil, err
+	}
+	wt, err := repo.git.Worktree()
+	if err != nil {
+		return nil, errors.New("Couldn't get WorkTree: " + err.Error())
+	}
+	if err := wt.Checkout(&git.CheckoutOptions{Hash: commit.Hash, Force: true}); err != nil {
+		return nil, errors.New("Couldn't checkout " + commit.Hash.String() + ": " + err.Error())
+	}
+	log.WithFields(log.Fields{
+		"ref":    repo.Ref,
+		"commit": commit.Hash.String(),
+	}).Info("Resolved ref")
+	return commit, nil
+}
+
+// fetchedHead returns the commit the next sync of the fetched repo would
+// apply, without checking it out.
+func fetchedHead(repo *syncedRepo) (*gitobj.Commit, error) {
+	if kind, _ := trackedRef(repo); kind != refBranch {
+		return lookupRef(repo)
+	}
+	ref, err := repo.git.Reference(remoteBranchRef(repo), true)
+	if err != nil {
+		return nil, errors.New("Couldn't get remote branch: " + err.Error())
+	}
+	commit, err := repo.git.CommitObject(ref.Hash())
+	if err != nil {
+		return nil, errors.New("Couldn't get commit: " + err.Error())
+	}
+	return commit, nil
+}
+
+// lookupRef returns the commit repo.ref designates when it isn't a branch.
+func lookupRef(repo *syncedRepo) (*gitobj.Commit, error) {
+	kind, name := trackedRef(repo)
+	var commit *gitobj.Commit
+	var err error
+	switch kind {
+	case refCommit:
+		if commit, err = repo.git.CommitObject(plumbing.NewHash(name)); err != nil {
+			return nil, fmt.Errorf("Couldn't get commit %s (depth is %d): %s", name, repo.Depth, err.Error())
+		}
+	case refTagPattern:
+		if name, err = highestTag(repo.git, name); err != nil {
+			return nil, err
+		}
+		fallthrough
+	case refTag:
+		if commit, err = tagCommit(repo.git, name); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("Ref " + name + " is a branch")
+	}
+	return commit, nil
+}
+
+// tagCommit returns the commit tag points to, whether it's annotated or not.
+func tagCommit(repo *git.Repository, tag string) (*gitobj.Commit, error) {
+	ref, err := repo.Reference(plumbing.ReferenceName("refs/tags/"+tag), true)
+	if err != nil {
+		return nil, errors.New("Couldn't find tag " + tag + ": " + err.Error())
+	}
+	if annotated, err := repo.TagObject(ref.Hash()); err == nil {
+		commit, err := annotated.Commit()
+		if err != nil {
+			return nil, errors.New("Couldn't get commit of tag " + tag + ": " + err.Error())
+		}
+		return commit, nil
+	}
+	commit, err := repo.CommitObject(ref.Hash())
+	if err != nil {
+		return nil, errors.New("Couldn't get commit of tag " + tag + ": " + err.Error())
+	}
+	return commit, nil
+}
+
+// highestTag returns the tag matching pattern with the highest version, the
+// version being what follows the part of the pattern before its first *, with
+// an optional v, like 1.2.3 for prod-v1.2.3 and prod-*.
+func highestTag(repo *git.Repository, pattern string) (string, error) {
+	tags, err := repo.Tags()
+	if err != nil {
+		return "", errors.New("Couldn't list tags: " + err.Error())
+	}
+	prefix := pattern[:strings.Index(pattern, "*")]
+	var highest *semver.Version
+	tag := ""
+	err = tags.ForEach(func(ref *plumbing.Reference) error {
+		name := strings.TrimPrefix(ref.Name().String(), "refs/tags/")
+		if ok, _ := path.Match(pattern, name); !ok {
+			return nil
+		}
+		version, err := semver.NewVersion(strings.TrimPrefix(strings.TrimPrefix(name, prefix), "v"))
+		if err != nil {
+			log.WithField("tag", name).Debug("Ignoring tag without version")
+			return nil
+		}
+		if highest == nil || highest.LessThan(*version) {
+			highest, tag = version, name
+		}
+		return nil
+	})
+	if err != nil {
+		return "", errors.New("Couldn't list tags: " + err.Error())
+	}
+	if tag == "" {
+		return "", errors.New("No tag matches " + pattern)
+	}
+	return tag, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+func TestHighestTag(t *testing.T) {
+	r := newTestRepo(t)
+	commit := testCommit(t, r, map[string]string{"a": "1"})
+	for _, tag := range []string{
+		"prod-v1.2.0",
+		"prod-v1.10.0",
+		"prod-v1.9.3",
+		"prod-latest",
+		"staging-2.0.0",
+		"v1.0.0-rc.1",
+		"v1.0.0",
+		"v0.9.0",
+	} {
+		if err := r.Storer.SetReference(plumbing.NewHashReference(plumbing.ReferenceName("refs/tags/"+tag), commit.Hash)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		pattern string
+		want    string
+	}{
+		{"prod-*", "prod-v1.10.0"},
+		{"staging-*", "staging-2.0.0"},
+		{"v*", "v1.0.0"},
+		{"dev-*", ""},
+	}
+	for _, test := range tests {
+		tag, err := highestTag(r, test.pattern)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%s: got %q, want an error", test.pattern, tag)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.pattern, err)
+			continue
+		}
+		if tag != test.want {
+			t.Errorf("%s: got %q, want %q", test.pattern, tag, test.want)
+		}
+	}
+}
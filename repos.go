@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+type repoAuth struct {
+	Type string
+	SSH  struct {
+		Key        string
+		Passphrase string
+	}
+	HTTP struct {
+		Username string
+		Password string
+	}
+}
+
+// syncedRepo is a repository synced under its own key prefix, with its own
+// clone, webhook and sync state.
+type syncedRepo struct {
+	Name      string
+	URL       string
+	Branch    string
+	Ref       string
+	Path      string
+	Depth     int
+	SyncCycle int
+	Prefix    string
+	Overlay   []string
+	Hook      string
+	Provider  string
+	Secret    string
+	Auth      repoAuth
+
+	// lock is held while using the clone or the applied commit
+	lock          sync.Mutex
+	git           *git.Repository
+	appliedCommit plumbing.Hash
+	// pinnedCommit is the commit of the last rollback until the next explicit sync
+	pinnedCommit plumbing.Hash
+	// pending holds the jobs waiting for the worker, woken through wake
+	pending []*syncJob
+	wake    chan struct{}
+	// results holds the keys written by the running job
+	results []keyResult
+	// lastSync is the outcome of the last finished job, and commits the state
+	// it left, both guarded by the jobs lock
+	lastSync syncStatus
+	commits  repoCommits
+	// watched caches the keys of the applied commit for the watch
+	watched struct {
+		sync.Mutex
+		commit plumbing.Hash
+		state  *treeState
+	}
+}
+
+var repos []*syncedRepo
+
+// defaultRepo returns a repo configured by the repo, auth, host and etcd.prefix
+// keys, which the entries of repos override.
+func defaultRepo() *syncedRepo {
+	repo := &syncedRepo{
+		Name:      viper.GetString("repo.name"),
+		URL:       viper.GetString("repo.url"),
+		Branch:    viper.GetString("repo.branch"),
+		Ref:       viper.GetString("repo.ref"),
+		Path:      viper.GetString("repo.path"),
+		Depth:     viper.GetInt("repo.depth"),
+		SyncCycle: viper.GetInt("repo.synccycle"),
+		Prefix:    viper.GetString("etcd.prefix"),
+		Overlay:   viper.GetStringSlice("repo.overlay"),
+		Hook:      viper.GetString("host.hook"),
+		Provider:  viper.GetString("host.provider"),
+		Secret:    viper.GetString("host.secret"),
+	}
+	repo.Auth.Type = viper.GetString("auth.type")
+	repo.Auth.SSH.Key = viper.GetString("auth.ssh.key")
+	repo.Auth.SSH.Passphrase = viper.GetString("auth.ssh.passphrase")
+	repo.Auth.HTTP.Username = viper.GetString("auth.http.username")
+	repo.Auth.HTTP.Password = viper.GetString("auth.http.password")
+	return repo
+}
+
+// loadRepos reads the repos list, or the single repo of the repo keys when
+// there's no list.
+func loadRepos() error {
+	list := []*syncedRepo{}
+	if !viper.IsSet("repos") {
+		list = append(list, defaultRepo())
+	} else {
+		entries, ok := viper.Get("repos").([]interface{})
+		if !ok {
+			return errors.New("repos must be a list")
+		}
+		if len(entries) == 0 {
+			return errors.New("repos must list at least one repo")
+		}
+		for i, entry := range entries {
+			repo := defaultRepo()
+			repo.Name, repo.URL, repo.Path, repo.Hook = "", "", "", ""
+			decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{Result: repo, WeaklyTypedInput: true})
+			if err != nil {
+				return err
+			}
+			if err := decoder.Decode(entry); err != nil {
+				return fmt.Errorf("Couldn't read repo %d: %s", i, err.Error())
+			}
+			if repo.URL == "" {
+				return fmt.Errorf("Repo %d has no url", i)
+			}
+			if repo.Name == "" {
+				repo.Name = urlName(repo.URL)
+			}
+			if repo.Path == "" {
+				repo.Path = path.Join(viper.GetString("repo.path"), repo.Name)
+			}
+			if repo.Hook == "" {
+				repo.Hook = path.Join(viper.GetString("host.hook"), repo.Name)
+			}
+			list = append(list, repo)
+		}
+	}
+	for _, repo := range list {
+		if repo.Name == "" {
+			repo.Name = urlName(repo.URL)
+		}
+		repo.Name = strings.Trim(repo.Name, "/")
+		if repo.Branch == "" {
+			// Default value is not correctly assigned to repo.branch when using json config, forcing it here
+			repo.Branch = "master"
+		}
+		repo.Prefix = path.Join("/", repo.Prefix)
+		for i, layer := range repo.Overlay {
+			if repo.Overlay[i] = strings.Trim(layer, "/"); repo.Overlay[i] == "" {
+				return errors.New("Overlay layers of repo " + repo.Name + " must be directories")
+			}
+		}
+		if underPrefix(repo.Prefix, stateDir()) {
+			return errors.New("Prefix " + repo.Prefix + " of repo " + repo.Name + " is in the state directory")
+		}
+	}
+	if err := checkRepos(list); err != nil {
+		return err
+	}
+	repos = list
+	return nil
+}
+
+// checkRepos refuses repos sharing a name, a clone or a webhook, and the ones
+// whose keys would overlap.
+func checkRepos(list []*syncedRepo) error {
+	for i, a := range list {
+		for _, b := range list[i+1:] {
+			switch {
+			case a.Name == b.Name:
+				return errors.New("Several repos are named " + a.Name)
+			case path.Clean(a.Path) == path.Clean(b.Path):
+				return errors.New("Repos " + a.Name + " and " + b.Name + " share the path " + a.Path)
+			case a.Hook == b.Hook:
+				return errors.New("Repos " + a.Name + " and " + b.Name + " share the webhook " + a.Hook)
+			case underPrefix(a.Prefix, b.Prefix) || underPrefix(b.Prefix, a.Prefix):
+				return errors.New("Prefixes " + a.Prefix + " of " + a.Name + " and " + b.Prefix + " of " + b.Name + " overlap")
+			}
+		}
+	}
+	return nil
+}
+
+// urlName is the last element of url without its .git extension.
+func urlName(url string) string {
+	url = strings.TrimSuffix(strings.TrimSuffix(url, "/"), ".git")
+	return url[strings.LastIndexAny(url, "/:")+1:]
+}
+
+// findRepo returns the repo called name, which may be left empty when there's
+// a single repo.
+func findRepo(name string) (*syncedRepo, error) {
+	if name == "" {
+		switch len(repos) {
+		case 0:
+			return nil, errors.New("No repo is synced")
+		case 1:
+			return repos[0], nil
+		}
+		return nil, errors.New("Several repos are synced, pick one")
+	}
+	for _, repo := range repos {
+		if repo.Name == name {
+			return repo, nil
+		}
+	}
+	return nil, errors.New("Unknown repo " + name)
+}
+
+// requestRepo returns the repo of the repo query parameter, answering with an
+// error when there's none.
+func requestRepo(w http.ResponseWriter, r *http.Request) (*syncedRepo, bool) {
+	repo, err := findRepo(r.URL.Query().Get("repo"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return repo, true
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// rollbackRepo applies the commit rev resolves to, whatever the head of the
+// repo, and pins the store to it until the next explicit sync. The pin is
+// written first, so that watches and drift checks leave the keys of the
+// rollback alone while they're written.
+func rollbackRepo(repo *syncedRepo, rev string) error {
+	hash, err := repo.git.ResolveRevision(plumbing.Revision(rev))
+	if err != nil {
+		return fmt.Errorf("Couldn't find commit %s in the clone (depth is %d): %s", rev, repo.Depth, err.Error())
+	}
+	commit, err := repo.git.CommitObject(*hash)
+	if err != nil {
+		return errors.New("Couldn't get commit " + hash.String() + ": " + err.Error())
+	}
+	log.WithFields(log.Fields{
+		"commit": hash.String(),
+		"repo":   repo.Name,
+		"from":   repo.appliedCommit.String(),
+	}).Warn("Rolling back")
+	if err := setPinned(repo, *hash); err != nil {
+		return err
+	}
+	return applyCommit(repo, commit, false)
+}
+
+// setPinned records hash as the commit automatic syncs must keep the store
+// at, or unpins the store when hash is zero.
+func setPinned(repo *syncedRepo, hash plumbing.Hash) error {
+	if hash == repo.pinnedCommit {
+		return nil
+	}
+	op := storeOp{Type: opSet, Key: metaDir(repo) + "/pinned", Value: hash.String()}
+	if hash.IsZero() {
+		op = storeOp{Type: opDelete, Key: op.Key}
+	}
+	if err := writeOps(repo, []storeOp{op}); err != nil {
+		return errors.New("Couldn't record pinned commit: " + err.Error())
+	}
+	repo.pinnedCommit = hash
+	if hash.IsZero() {
+		log.Info("Unpinned, syncing the head of the branch again")
+	}
+	return nil
+}
+
+// loadPinnedCommit reads the pin of the store, which a restart, the rollback
+// command or another instance may have changed.
+func loadPinnedCommit(repo *syncedRepo) error {
+	val, ok, err := store.Get(metaDir(repo) + "/pinned")
+	if err != nil {
+		return errors.New("Couldn't get pinned commit: " + err.Error())
+	}
+	pinned := plumbing.ZeroHash
+	if ok {
+		pinned = plumbing.NewHash(val)
+	}
+	if pinned != repo.pinnedCommit && ok {
+		log.WithField("commit", val).Warn("Pinned by a rollback, automatic syncs are off until an explicit sync")
+	}
+	repo.pinnedCommit = pinned
+	return nil
+}
+
+// recordedState reads the sync state of repo again before comparing keys with
+// the applied commit, failing while a rollback is being written.
+func recordedState(repo *syncedRepo) error {
+	if err := loadSyncState(repo); err != nil {
+		return err
+	}
+	if !repo.pinnedCommit.IsZero() && repo.pinnedCommit != repo.appliedCommit {
+		return errors.New("Rollback to " + repo.pinnedCommit.String() + " in progress")
+	}
+	return nil
+}
+
+// errNotLeading is returned by the automatic syncs left to another instance.
+var errNotLeading = errors.New("Not leading")
+
+// autoSyncRepo syncs repo unless the store was pinned by a rollback, or
+// another instance leads.
+func autoSyncRepo(repo *syncedRepo) error {
+	if !isLeader() {
+		log.WithField("repo", repo.Name).Debug("Not leading, skipping sync")
+		return errNotLeading
+	}
+	if !repo.pinnedCommit.IsZero() {
+		log.WithField("commit", repo.pinnedCommit.String()).Info("Pinned by a rollback, skipping sync")
+		return nil
+	}
+	return syncRepo(repo, false)
+}
+
+func rollbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rev := r.URL.Query().Get("commit")
+	if rev == "" {
+		http.Error(w, "Missing commit", http.StatusBadRequest)
+		return
+	}
+	repo, ok := requestRepo(w, r)
+	if !ok {
+		return
+	}
+	waitJobs(w, r, []*syncJob{enqueueJob(repo, jobRollback, rev, "api")})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// TestRollbackCommand runs a rollback the way the rollback command does, next
+// to a server that applied the head, then an explicit sync on the server.
+func TestRollbackCommand(t *testing.T) {
+	defer viper.Reset()
+	defer func() { store = nil }()
+	viper.Set("etcd.statedir", "/_git2etcd")
+	mem := newMemStore()
+	store = mem
+	r := newTestRepo(t)
+	old := testCommit(t, r, map[string]string{"a": "1", "b": "2"})
+	head := testCommit(t, r, map[string]string{"a": "3"})
+
+	server := &syncedRepo{Name: "r", Prefix: "/p", git: r}
+	if err := syncCommit(server, head, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Storer.SetReference(plumbing.NewHashReference("refs/tags/v1", old.Hash)); err != nil {
+		t.Fatal(err)
+	}
+	cli := &syncedRepo{Name: "r", Prefix: "/p", git: r}
+	if err := loadSyncState(cli); err != nil {
+		t.Fatal(err)
+	}
+	if err := rollbackRepo(cli, "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if mem.kvs["/p/a"] != "1" || mem.kvs["/p/b"] != "2" || mem.kvs["/_git2etcd/r/pinned"] != old.Hash.String() {
+		t.Fatalf("got %v after the rollback", mem.kvs)
+	}
+
+	// Watches and drift checks of the server compare with the rollback
+	state, err := appliedState(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.kvs["/p/a"] != "1" || server.appliedCommit != old.Hash || server.pinnedCommit != old.Hash {
+		t.Errorf("server compares with %v of %s, pinned to %s", state.kvs, server.appliedCommit, server.pinnedCommit)
+	}
+	check, err := checkDrift(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(check.Drifts) != 0 {
+		t.Errorf("got drifts %+v after the rollback", check.Drifts)
+	}
+
+	// Automatic syncs leave the rollback alone
+	if err := autoSyncRepo(server); err != nil {
+		t.Fatal(err)
+	}
+	if mem.kvs["/p/a"] != "1" {
+		t.Errorf("automatic sync overwrote the rollback: %v", mem.kvs)
+	}
+
+	// An explicit sync brings back the head and unpins
+	if err := syncCommit(server, head, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := mem.kvs["/p/b"]; ok || mem.kvs["/p/a"] != "3" || mem.kvs["/_git2etcd/r/commit"] != head.Hash.String() {
+		t.Errorf("got %v after the explicit sync", mem.kvs)
+	}
+	if _, ok := mem.kvs["/_git2etcd/r/pinned"]; ok || server.appliedCommit != head.Hash || !server.pinnedCommit.IsZero() {
+		t.Errorf("still pinned after the explicit sync: %v", mem.kvs)
+	}
+}
+
+func TestRollbackInProgress(t *testing.T) {
+	defer viper.Reset()
+	defer func() { store = nil }()
+	viper.Set("etcd.statedir", "/_git2etcd")
+	mem := newMemStore()
+	store = mem
+	r := newTestRepo(t)
+	old := testCommit(t, r, map[string]string{"a": "1"})
+	head := testCommit(t, r, map[string]string{"a": "2"})
+	server := &syncedRepo{Name: "r", Prefix: "/p", git: r}
+	if err := syncCommit(server, head, false); err != nil {
+		t.Fatal(err)
+	}
+	// The rollback command pinned, and didn't write the commit yet
+	mem.kvs["/_git2etcd/r/pinned"] = old.Hash.String()
+	mem.kvs["/p/a"] = "1"
+	if _, err := appliedState(server); err == nil {
+		t.Error("want an error while the rollback is written")
+	}
+	if _, err := checkDrift(server); err == nil {
+		t.Error("want an error while the rollback is written")
+	}
+	if server.pinnedCommit != old.Hash || server.appliedCommit != head.Hash {
+		t.Errorf("got pinned %s and applied %s", server.pinnedCommit, server.appliedCommit)
+	}
+	mem.kvs["/_git2etcd/r/commit"] = old.Hash.String()
+	if _, err := appliedState(server); err != nil {
+		t.Error(err)
+	}
+	if server.appliedCommit != old.Hash || server.pinnedCommit != old.Hash {
+		t.Errorf("got pinned %s and applied %s", server.pinnedCommit, server.appliedCommit)
+	}
+}
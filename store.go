@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Store is the key-value backend the repository is synced into. Keys are
+// absolute paths like "/dir/file" whatever the backend.
+type Store interface {
+	// Get returns the value of key, and false if it doesn't exist
+	Get(key string) (string, bool, error)
+	// List returns all the keys and values found under dir
+	List(dir string) (map[string]string, error)
+	// Create sets key, failing if it already exists
+	Create(key, val string) error
+	Set(key, val string) error
+	Delete(key string) error
+	// Check returns an error when the backend can't be reached
+	Check() error
+}
+
+// TxnStore is implemented by stores able to apply several operations
+// atomically, up to MaxTxnOps at once.
+type TxnStore interface {
+	Store
+	Txn(ops []storeOp) error
+	MaxTxnOps() int
+}
+
+// storeEvent is a change of a key seen by a watch.
+type storeEvent struct {
+	Key     string
+	Value   string
+	Deleted bool
+	// Revision is the etcd v3 revision, or the v2 index, of the change
+	Revision uint64
+}
+
+// WatchStore is implemented by stores able to report the changes of keys.
+type WatchStore interface {
+	Store
+	// Watch calls fn for each change under dir, until the watch fails
+	Watch(dir string, fn func(storeEvent)) error
+}
+
+// LeaseStore is implemented by stores able to hold a key for a limited time,
+// which leader election relies on.
+type LeaseStore interface {
+	Store
+	// Acquire sets key to val for ttl unless it exists, or extends it when it
+	// already holds val. It returns whether key holds val.
+	Acquire(key, val string, ttl time.Duration) (bool, error)
+	// Release deletes key if it was acquired with val
+	Release(key, val string) error
+}
+
+// storeHosts returns the etcd endpoints, etcd.host taking precedence.
+func storeHosts() []string {
+	if viper.IsSet("etcd.host") {
+		return []string{viper.GetString("etcd.host")}
+	}
+	return viper.GetStringSlice("etcd.hosts")
+}
+
+// storeTransport returns the transport to etcd, with the client certificate
+// and CA of etcd.tls when set.
+func storeTransport() (*http.Transport, error) {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		Dial: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	cert, key, ca := viper.GetString("etcd.tls.cert"), viper.GetString("etcd.tls.key"), viper.GetString("etcd.tls.ca")
+	if cert == "" && ca == "" {
+		return transport, nil
+	}
+	config := &tls.Config{}
+	if cert != "" {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, errors.New("Couldn't load etcd client certificate : " + err.Error())
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+	if ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, errors.New("Couldn't read etcd CA : " + err.Error())
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("Couldn't read etcd CA : no certificate in " + ca)
+		}
+	}
+	transport.TLSClientConfig = config
+	return transport, nil
+}
+
+func storeConnect() error {
+	hosts := storeHosts()
+	transport, err := storeTransport()
+	if err != nil {
+		return err
+	}
+	healthClient.Transport = transport
+	username, password := viper.GetString("etcd.username"), viper.GetString("etcd.password")
+	switch viper.GetString("etcd.api") {
+	case "v2":
+		store, err = newEtcdV2Store(hosts, transport, username, password)
+	case "v3":
+		store, err = newEtcdV3Store(hosts, transport, username, password, viper.GetString("etcd.v3.gateway"), viper.GetInt("etcd.v3.maxtxnops"))
+	default:
+		return errors.New("Unknown etcd API " + viper.GetString("etcd.api"))
+	}
+	if err != nil {
+		return err
+	}
+	return store.Check()
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+// memStore is an in-memory Store, failing the writes of the keys in fail.
+type memStore struct {
+	sync.Mutex
+	kvs  map[string]string
+	fail map[string]bool
+	// writes holds the keys written, in order
+	writes []string
+}
+
+func newMemStore() *memStore {
+	return &memStore{kvs: map[string]string{}, fail: map[string]bool{}}
+}
+
+func (s *memStore) Get(key string) (string, bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	val, ok := s.kvs[key]
+	return val, ok, nil
+}
+
+func (s *memStore) List(dir string) (map[string]string, error) {
+	s.Lock()
+	defer s.Unlock()
+	kvs := map[string]string{}
+	for key, val := range s.kvs {
+		if underPrefix(key, dir) {
+			kvs[key] = val
+		}
+	}
+	return kvs, nil
+}
+
+func (s *memStore) Create(key, val string) error {
+	if _, ok, _ := s.Get(key); ok {
+		return errors.New("Key already exists")
+	}
+	return s.Set(key, val)
+}
+
+func (s *memStore) Set(key, val string) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.fail[key] {
+		return errors.New("Couldn't set key " + key)
+	}
+	s.kvs[key] = val
+	s.writes = append(s.writes, key)
+	return nil
+}
+
+func (s *memStore) Delete(key string) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.fail[key] {
+		return errors.New("Couldn't delete key " + key)
+	}
+	delete(s.kvs, key)
+	s.writes = append(s.writes, key)
+	return nil
+}
+
+func (s *memStore) Check() error {
+	return nil
+}
+
+// memTxnStore is a memStore applying transactions of up to max operations,
+// failing the whole transaction when one of its keys fails.
+type memTxnStore struct {
+	*memStore
+	max int
+	// txns holds the keys of each transaction applied
+	txns [][]string
+}
+
+func (s *memTxnStore) Txn(ops []storeOp) error {
+	keys := []string{}
+	for _, op := range ops {
+		if s.fail[op.Key] {
+			return errors.New("Couldn't commit " + strings.Join(append(keys, op.Key), ", "))
+		}
+		keys = append(keys, op.Key)
+	}
+	for _, op := range ops {
+		applyOp(op)
+	}
+	s.txns = append(s.txns, keys)
+	return nil
+}
+
+func (s *memTxnStore) MaxTxnOps() int {
+	return s.max
+}
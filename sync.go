@@ -0,0 +1,443 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	gitobj "gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+type opType int
+
+const (
+	opSet opType = iota
+	opDelete
+)
+
+// storeOp is a single write to apply to the store.
+type storeOp struct {
+	Type  opType
+	Key   string
+	Value string
+	// File is the file a set key comes from
+	File string
+	// Created tells a set key didn't exist before
+	Created bool
+}
+
+// applyCommit brings the store to the state of commit. Only the files changed
+// since the last applied commit are written when that commit is still known,
+// otherwise, or when full is set, the whole tree is.
+func applyCommit(repo *syncedRepo, commit *gitobj.Commit, full bool) error {
+	if commit.Hash == repo.appliedCommit && !full {
+		log.WithField("commit", commit.Hash.String()).Info("Commit already applied")
+		return nil
+	}
+	ops, err := commitOps(repo, commit, full)
+	if err != nil {
+		return err
+	}
+	if err := applyOps(repo, ops, commit); err != nil {
+		return err
+	}
+	repo.appliedCommit = commit.Hash
+	log.WithFields(log.Fields{
+		"repo":   repo.Name,
+		"commit": commit.Hash.String(),
+	}).Info("Repo synced")
+	return nil
+}
+
+// commitOps returns the operations bringing the store from the applied commit
+// to commit: the ones of the changed files, or of the whole tree when full is
+// set or the diff can't be done.
+func commitOps(repo *syncedRepo, commit *gitobj.Commit, full bool) ([]storeOp, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, errors.New("Couldn't get commit tree: " + err.Error())
+	}
+	if !full {
+		ops, err := diffOps(repo, repo.appliedCommit, tree)
+		if err == nil {
+			return ops, nil
+		}
+		log.WithError(err).Warn("Couldn't diff with applied commit, falling back to full sync")
+	}
+	return treeOps(repo, tree)
+}
+
+// appliedTree returns the tree of the applied commit, or of the head of repo if
+// none was applied yet.
+func appliedTree(repo *syncedRepo) (*gitobj.Tree, plumbing.Hash, error) {
+	hash := repo.appliedCommit
+	if hash.IsZero() {
+		head, err := repo.git.Head()
+		if err != nil {
+			return nil, hash, errors.New("Couldn't get head: " + err.Error())
+		}
+		hash = head.Hash()
+	}
+	commit, err := repo.git.CommitObject(hash)
+	if err != nil {
+		return nil, hash, errors.New("Couldn't get commit " + hash.String() + ": " + err.Error())
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, hash, errors.New("Couldn't get commit tree: " + err.Error())
+	}
+	return tree, hash, nil
+}
+
+// diffOps returns the operations turning the tree of the from commit into tree.
+func diffOps(repo *syncedRepo, from plumbing.Hash, tree *gitobj.Tree) ([]storeOp, error) {
+	if from.IsZero() {
+		return nil, errors.New("No commit applied yet")
+	}
+	commit, err := repo.git.CommitObject(from)
+	if err != nil {
+		return nil, errors.New("Couldn't get applied commit " + from.String() + ": " + err.Error())
+	}
+	fromTree, err := commit.Tree()
+	if err != nil {
+		return nil, errors.New("Couldn't get applied commit tree: " + err.Error())
+	}
+	if len(repo.Overlay) > 0 {
+		// A change in a layer may be hidden by another one, compare the results
+		return overlayDiffOps(repo, fromTree, tree)
+	}
+	changes, err := gitobj.DiffTree(fromTree, tree)
+	if err != nil {
+		return nil, errors.New("Couldn't diff trees: " + err.Error())
+	}
+	fromFilter, err := newFileFilter(fromTree)
+	if err != nil {
+		return nil, err
+	}
+	toFilter, err := newFileFilter(tree)
+	if err != nil {
+		return nil, err
+	}
+	log.WithFields(log.Fields{
+		"from":    from.String(),
+		"changes": len(changes),
+	}).Info("Applying diff")
+	// Changes are merged before comparing, as a key may move from a file to
+	// another, like when renaming a file whose extension isn't in its keys
+	oldKVs, newKVs := map[string]string{}, map[string]string{}
+	files := map[string]string{}
+	for _, change := range changes {
+		if change.From.Name == ignoreFile || change.To.Name == ignoreFile {
+			// Files unchanged by the diff may have been ignored or unignored
+			return nil, errors.New(ignoreFile + " changed")
+		}
+		// The files are named after their tree entry, the changes hold their path
+		from, to, err := change.Files()
+		if err != nil {
+			return nil, errors.New("Couldn't get changed files: " + err.Error())
+		}
+		fromKVs, toKVs := map[string]string{}, map[string]string{}
+		if from != nil && fromFilter.synced(change.From.Name) {
+			if fromKVs, err = gitFileKeys(repo.Prefix, change.From.Name, from); err != nil {
+				log.WithError(err).WithField("name", change.From.Name).Warn("Couldn't read previous file")
+				fromKVs = map[string]string{}
+			}
+		}
+		if to != nil && toFilter.synced(change.To.Name) {
+			if toKVs, err = gitFileKeys(repo.Prefix, change.To.Name, to); err != nil {
+				// Going on would delete the keys of the file
+				return nil, err
+			}
+		}
+		for key, val := range fromKVs {
+			oldKVs[key] = val
+		}
+		for key, val := range toKVs {
+			newKVs[key] = val
+			files[key] = change.To.Name
+		}
+	}
+	ops := kvOps(oldKVs, newKVs)
+	for i := range ops {
+		ops[i].File = files[ops[i].Key]
+	}
+	return ops, nil
+}
+
+// overlayDiffOps returns the operations turning the keys of the layers of
+// fromTree into the ones of tree.
+func overlayDiffOps(repo *syncedRepo, fromTree, tree *gitobj.Tree) ([]storeOp, error) {
+	from, err := treeKeys(repo, fromTree)
+	if err != nil {
+		return nil, err
+	}
+	to, err := treeKeys(repo, tree)
+	if err != nil {
+		return nil, err
+	}
+	ops := kvOps(from.kvs, to.kvs)
+	for i := range ops {
+		ops[i].File = to.files[ops[i].Key]
+	}
+	return ops, nil
+}
+
+// treeOps returns the operations writing every file of tree, and pruning the
+// stale keys if enabled.
+func treeOps(repo *syncedRepo, tree *gitobj.Tree) ([]storeOp, error) {
+	state, err := treeKeys(repo, tree)
+	if err != nil {
+		return nil, err
+	}
+	ops := kvOps(map[string]string{}, state.kvs)
+	for i := range ops {
+		ops[i].File = state.files[ops[i].Key]
+	}
+	current, err := store.List(repo.Prefix)
+	if err != nil {
+		err = errors.New("Couldn't list current keys: " + err.Error())
+		if viper.GetBool("repo.prune") {
+			return nil, err
+		}
+		log.WithError(err).Warn("Couldn't look for keys of ignored files")
+		return ops, nil
+	}
+	for i := range ops {
+		_, exists := current[ops[i].Key]
+		ops[i].Created = !exists
+	}
+	for _, key := range sortedKeys(state.ignored) {
+		if _, ok := current[key]; ok {
+			log.WithFields(log.Fields{
+				"key":   key,
+				"name":  state.ignored[key],
+				"prune": viper.GetBool("repo.prune"),
+			}).Warn("Ignored file has a key in etcd")
+		}
+	}
+	if viper.GetBool("repo.prune") {
+		pruned, err := pruneOps(repo.Prefix, state.kvs, current)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, pruned...)
+	}
+	return ops, nil
+}
+
+// treeState holds the keys the files of a tree are stored as.
+type treeState struct {
+	// kvs holds the values of the keys of the synced files
+	kvs map[string]string
+	// files holds the file each key comes from
+	files map[string]string
+	// layers holds the overlay layer each key comes from
+	layers map[string]string
+	// ignored holds the ignored file each key would have come from
+	ignored map[string]string
+}
+
+// treeKeys returns the keys the files of tree are stored as by repo.
+func treeKeys(repo *syncedRepo, tree *gitobj.Tree) (*treeState, error) {
+	synced, ignored, err := syncedFiles(repo, tree)
+	if err != nil {
+		return nil, err
+	}
+	state := &treeState{
+		kvs:     map[string]string{},
+		files:   map[string]string{},
+		layers:  map[string]string{},
+		ignored: map[string]string{},
+	}
+	failed := []string{}
+	for _, f := range synced {
+		fileKVs, err := gitFileKeys(repo.Prefix, f.Path, f.File)
+		if err != nil {
+			log.WithError(err).WithField("name", f.Name).Error("Couldn't read file")
+			failed = append(failed, f.Name)
+			continue
+		}
+		for key, val := range fileKVs {
+			state.kvs[key] = val
+			state.files[key] = f.Name
+			state.layers[key] = f.Layer
+		}
+	}
+	for _, f := range ignored {
+		fileKVs, err := gitFileKeys(repo.Prefix, f.Path, f.File)
+		if err != nil {
+			log.WithError(err).WithField("name", f.Name).Warn("Couldn't read file")
+			continue
+		}
+		for key := range fileKVs {
+			state.ignored[key] = f.Name
+		}
+	}
+	if len(failed) > 0 {
+		// Their keys would be taken as stale and pruned
+		return nil, errors.New("Couldn't read files " + strings.Join(failed, ", "))
+	}
+	return state, nil
+}
+
+// pruneOps deletes every current key under prefix that isn't in kvs anymore.
+// Nothing is deleted if more than repo.prunelimit keys would go, as it most
+// likely means the clone is broken rather than the repo emptied.
+func pruneOps(prefix string, kvs, current map[string]string) ([]storeOp, error) {
+	stale := []string{}
+	for key := range current {
+		if !underPrefix(key, prefix) || underPrefix(key, stateDir()) {
+			continue
+		}
+		if _, ok := kvs[key]; !ok {
+			stale = append(stale, key)
+		}
+	}
+	sort.Strings(stale)
+	limit := viper.GetInt("repo.prunelimit")
+	if limit > 0 && len(stale) > limit {
+		return nil, fmt.Errorf("Refusing to prune %d keys, limit is %d", len(stale), limit)
+	}
+	ops := []storeOp{}
+	for _, key := range stale {
+		log.WithField("key", key).Info("Pruning key")
+		ops = append(ops, storeOp{Type: opDelete, Key: key})
+	}
+	return ops, nil
+}
+
+// kvOps returns the operations turning the keys of from into the ones of to.
+func kvOps(from, to map[string]string) []storeOp {
+	ops := []storeOp{}
+	for _, key := range sortedKeys(to) {
+		if val, ok := from[key]; !ok || val != to[key] {
+			ops = append(ops, storeOp{Type: opSet, Key: key, Value: to[key], Created: !ok})
+		}
+	}
+	for _, key := range sortedKeys(from) {
+		if _, ok := to[key]; !ok {
+			ops = append(ops, storeOp{Type: opDelete, Key: key})
+		}
+	}
+	return ops
+}
+
+func sortedKeys(kvs map[string]string) []string {
+	keys := []string{}
+	for key := range kvs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// applyOps writes ops followed by the metadata of commit. Stores supporting
+// transactions get them in as few transactions as their limit allows, the
+// metadata being part of the last ones.
+func applyOps(repo *syncedRepo, ops []storeOp, commit *gitobj.Commit) error {
+	meta := metadataOps(repo, ops, commit)
+	if _, ok := store.(TxnStore); ok {
+		results, err := writeOpsResults(repo, append(ops, meta...))
+		repo.results = append(repo.results, results[:len(ops)]...)
+		countKeys(repo, results[:len(ops)])
+		return err
+	}
+	results, err := writeOpsResults(repo, ops)
+	repo.results = append(repo.results, results...)
+	countKeys(repo, results)
+	if err != nil {
+		return err
+	}
+	return writeOps(repo, meta)
+}
+
+// keyResult is the outcome of the write of a key.
+type keyResult struct {
+	Key   string `json:"key"`
+	Op    string `json:"op"`
+	File  string `json:"file,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// writeOps writes ops in order, in transactions when the store supports them.
+func writeOps(repo *syncedRepo, ops []storeOp) error {
+	_, err := writeOpsResults(repo, ops)
+	return err
+}
+
+// writeOpsResults writes ops like writeOps, returning the outcome of each of
+// them. The ops of a failed transaction, and of the ones it stopped, all fail.
+func writeOpsResults(repo *syncedRepo, ops []storeOp) ([]keyResult, error) {
+	recordWrites(repo, ops)
+	results := make([]keyResult, len(ops))
+	for i, op := range ops {
+		results[i] = keyResult{Key: op.Key, Op: "update", File: op.File}
+		switch {
+		case op.Type == opDelete:
+			results[i].Op = "delete"
+		case op.Created:
+			results[i].Op = "create"
+		}
+	}
+	if txn, ok := store.(TxnStore); ok {
+		max := txn.MaxTxnOps()
+		batches := (len(ops) + max - 1) / max
+		for i := 0; i < batches; i++ {
+			end := (i + 1) * max
+			if end > len(ops) {
+				end = len(ops)
+			}
+			if err := txn.Txn(ops[i*max : end]); err != nil {
+				err = fmt.Errorf("Couldn't apply batch %d/%d: %s", i+1, batches, err.Error())
+				for j := i * max; j < len(ops); j++ {
+					results[j].Error = err.Error()
+				}
+				return results, err
+			}
+		}
+		return results, nil
+	}
+	failed := 0
+	for i, op := range ops {
+		if err := applyOp(op); err != nil {
+			log.WithError(err).WithField("key", op.Key).Warn("Couldn't write key")
+			results[i].Error = err.Error()
+			failed++
+		}
+	}
+	if failed > 0 {
+		return results, fmt.Errorf("Couldn't write %d keys out of %d", failed, len(ops))
+	}
+	return results, nil
+}
+
+func applyOp(op storeOp) error {
+	if op.Type == opDelete {
+		return store.Delete(op.Key)
+	}
+	return store.Set(op.Key, op.Value)
+}
+
+// gitFileKeys returns the keys f is stored as under prefix, name being the path
+// it is synced as.
+func gitFileKeys(prefix, name string, f *gitobj.File) (map[string]string, error) {
+	content, err := f.Contents()
+	if err != nil {
+		return nil, errors.New("Couldn't read file " + f.Name + " : " + err.Error())
+	}
+	return fileKeys(prefix, name, content)
+}
+
+// underPrefix tells whether key is dir itself or below it.
+func underPrefix(key, dir string) bool {
+	return dir == "/" || key == dir || strings.HasPrefix(key, dir+"/")
+}
+
+// stateDir is where git2etcd keeps its own keys, never pruned.
+func stateDir() string {
+	return "/" + strings.Trim(viper.GetString("etcd.statedir"), "/")
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	gitobj "gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+func newTestRepo(t *testing.T) *git.Repository {
+	r, err := git.Init(memory.NewStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// testCommit stores a commit whose tree holds files, by path.
+func testCommit(t *testing.T, r *git.Repository, files map[string]string) *gitobj.Commit {
+	sig := gitobj.Signature{Name: "test", Email: "test@example.com", When: time.Unix(0, 0)}
+	c := &gitobj.Commit{Author: sig, Committer: sig, Message: "test", TreeHash: testTree(t, r, files)}
+	obj := r.Storer.NewEncodedObject()
+	if err := c.Encode(obj); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := r.Storer.SetEncodedObject(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := r.CommitObject(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return commit
+}
+
+func testTree(t *testing.T, r *git.Repository, files map[string]string) plumbing.Hash {
+	entries := []gitobj.TreeEntry{}
+	dirs := map[string]map[string]string{}
+	for name, content := range files {
+		if i := strings.Index(name, "/"); i >= 0 {
+			if dirs[name[:i]] == nil {
+				dirs[name[:i]] = map[string]string{}
+			}
+			dirs[name[:i]][name[i+1:]] = content
+			continue
+		}
+		blob := r.Storer.NewEncodedObject()
+		blob.SetType(plumbing.BlobObject)
+		w, err := blob.Writer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+		w.Close()
+		hash, err := r.Storer.SetEncodedObject(blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, gitobj.TreeEntry{Name: name, Mode: filemode.Regular, Hash: hash})
+	}
+	for dir, dirFiles := range dirs {
+		entries = append(entries, gitobj.TreeEntry{Name: dir, Mode: filemode.Dir, Hash: testTree(t, r, dirFiles)})
+	}
+	// Git sorts directories as if their name ended with a slash
+	sortName := func(e gitobj.TreeEntry) string {
+		if e.Mode == filemode.Dir {
+			return e.Name + "/"
+		}
+		return e.Name
+	}
+	sort.Slice(entries, func(i, j int) bool { return sortName(entries[i]) < sortName(entries[j]) })
+	obj := r.Storer.NewEncodedObject()
+	if err := (&gitobj.Tree{Entries: entries}).Encode(obj); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := r.Storer.SetEncodedObject(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestKvOps(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to map[string]string
+		want     []storeOp
+	}{
+		{
+			name: "unchanged",
+			from: map[string]string{"/a": "1"},
+			to:   map[string]string{"/a": "1"},
+			want: []storeOp{},
+		},
+		{
+			name: "created, updated and deleted",
+			from: map[string]string{"/a": "1", "/b": "2"},
+			to:   map[string]string{"/a": "3", "/c": "4"},
+			want: []storeOp{
+				{Type: opSet, Key: "/a", Value: "3"},
+				{Type: opSet, Key: "/c", Value: "4", Created: true},
+				{Type: opDelete, Key: "/b"},
+			},
+		},
+		{
+			name: "emptied value",
+			from: map[string]string{"/a": "1"},
+			to:   map[string]string{"/a": ""},
+			want: []storeOp{{Type: opSet, Key: "/a", Value: ""}},
+		},
+	}
+	for _, test := range tests {
+		if got := kvOps(test.from, test.to); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDiffOps(t *testing.T) {
+	parseRules = []parseRule{{Glob: "*.y*ml", Arrays: "index"}}
+	defer func() { parseRules = nil }()
+	tests := []struct {
+		name     string
+		from, to map[string]string
+		want     []storeOp
+		err      bool
+	}{
+		{
+			name: "renamed extension",
+			from: map[string]string{"svc.yml": "port: 80\n"},
+			to:   map[string]string{"svc.yaml": "port: 80\n"},
+			want: []storeOp{},
+		},
+		{
+			name: "renamed extension and changed",
+			from: map[string]string{"svc.yml": "port: 80\nhost: a\n"},
+			to:   map[string]string{"svc.yaml": "port: 8080\n"},
+			want: []storeOp{
+				{Type: opSet, Key: "/p/svc/port", Value: "8080", File: "svc.yaml"},
+				{Type: opDelete, Key: "/p/svc/host"},
+			},
+		},
+		{
+			name: "unparsable file",
+			from: map[string]string{"svc.yml": "port: 80\n"},
+			to:   map[string]string{"svc.yml": "port: [80\n"},
+			err:  true,
+		},
+	}
+	for _, test := range tests {
+		r := newTestRepo(t)
+		repo := &syncedRepo{Prefix: "/p", git: r}
+		from, to := testCommit(t, r, test.from), testCommit(t, r, test.to)
+		tree, err := to.Tree()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := diffOps(repo, from.Hash, tree)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: got %+v, want an error", test.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDiffOpsChanges(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to map[string]string
+		want     []storeOp
+	}{
+		{
+			name: "unchanged",
+			from: map[string]string{"a": "1"},
+			to:   map[string]string{"a": "1"},
+			want: []storeOp{},
+		},
+		{
+			name: "created, updated and deleted",
+			from: map[string]string{"a": "1", "b": "2"},
+			to:   map[string]string{"a": "3", "dir/c": "4"},
+			want: []storeOp{
+				{Type: opSet, Key: "/p/a", Value: "3", File: "a"},
+				{Type: opSet, Key: "/p/dir/c", Value: "4", File: "dir/c", Created: true},
+				{Type: opDelete, Key: "/p/b"},
+			},
+		},
+		{
+			name: "moved key",
+			from: map[string]string{"a/b": "1", "c": "2"},
+			to:   map[string]string{"a/b": "1", "d/c": "2"},
+			want: []storeOp{
+				{Type: opSet, Key: "/p/d/c", Value: "2", File: "d/c", Created: true},
+				{Type: opDelete, Key: "/p/c"},
+			},
+		},
+	}
+	for _, test := range tests {
+		r := newTestRepo(t)
+		repo := &syncedRepo{Prefix: "/p", git: r}
+		from, to := testCommit(t, r, test.from), testCommit(t, r, test.to)
+		tree, err := to.Tree()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := diffOps(repo, from.Hash, tree)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPruneOps(t *testing.T) {
+	defer viper.Reset()
+	viper.Set("etcd.statedir", "/_git2etcd")
+	current := map[string]string{
+		"/p/a":                "1",
+		"/p/b":                "2",
+		"/p/c":                "3",
+		"/other/d":            "4",
+		"/_git2etcd/p/commit": "abc",
+	}
+	tests := []struct {
+		name   string
+		prefix string
+		kvs    map[string]string
+		limit  int
+		want   []storeOp
+		err    bool
+	}{
+		{
+			name:   "stale keys",
+			prefix: "/p",
+			kvs:    map[string]string{"/p/a": "1"},
+			limit:  100,
+			want:   []storeOp{{Type: opDelete, Key: "/p/b"}, {Type: opDelete, Key: "/p/c"}},
+		},
+		{
+			name:   "nothing stale",
+			prefix: "/p",
+			kvs:    map[string]string{"/p/a": "1", "/p/b": "2", "/p/c": "3"},
+			limit:  100,
+			want:   []storeOp{},
+		},
+		{
+			name:   "root prefix keeps the state directory",
+			prefix: "/",
+			kvs:    map[string]string{"/p/a": "1", "/p/b": "2", "/p/c": "3"},
+			limit:  100,
+			want:   []storeOp{{Type: opDelete, Key: "/other/d"}},
+		},
+		{
+			name:   "over the limit",
+			prefix: "/p",
+			kvs:    map[string]string{},
+			limit:  2,
+			err:    true,
+		},
+		{
+			name:   "at the limit",
+			prefix: "/p",
+			kvs:    map[string]string{"/p/a": "1"},
+			limit:  2,
+			want:   []storeOp{{Type: opDelete, Key: "/p/b"}, {Type: opDelete, Key: "/p/c"}},
+		},
+		{
+			name:   "no limit",
+			prefix: "/p",
+			kvs:    map[string]string{},
+			limit:  0,
+			want:   []storeOp{{Type: opDelete, Key: "/p/a"}, {Type: opDelete, Key: "/p/b"}, {Type: opDelete, Key: "/p/c"}},
+		},
+	}
+	for _, test := range tests {
+		viper.Set("repo.prunelimit", test.limit)
+		got, err := pruneOps(test.prefix, test.kvs, current)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: got %+v, want an error", test.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestWriteOpsResults(t *testing.T) {
+	defer func() { store = nil }()
+	ops := []storeOp{
+		{Type: opSet, Key: "/a", Value: "1", Created: true},
+		{Type: opSet, Key: "/b", Value: "2"},
+		{Type: opDelete, Key: "/c"},
+		{Type: opSet, Key: "/d", Value: "4"},
+		{Type: opSet, Key: "/e", Value: "5"},
+	}
+	tests := []struct {
+		name string
+		txn  bool
+		fail string
+		// txns holds the keys of each transaction expected
+		txns [][]string
+		// failed holds the keys expected to fail
+		failed []string
+	}{
+		{
+			name: "batches",
+			txn:  true,
+			txns: [][]string{{"/a", "/b"}, {"/c", "/d"}, {"/e"}},
+		},
+		{
+			name:   "failed batch stops the next ones",
+			txn:    true,
+			fail:   "/d",
+			txns:   [][]string{{"/a", "/b"}},
+			failed: []string{"/c", "/d", "/e"},
+		},
+		{
+			name:   "one key at a time",
+			fail:   "/b",
+			failed: []string{"/b"},
+		},
+	}
+	for _, test := range tests {
+		mem := newMemStore()
+		mem.fail[test.fail] = true
+		txn := &memTxnStore{memStore: mem, max: 2}
+		if test.txn {
+			store = txn
+		} else {
+			store = mem
+		}
+		results, err := writeOpsResults(&syncedRepo{Name: "r"}, ops)
+		if (err != nil) != (len(test.failed) > 0) {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+		if test.txn && !reflect.DeepEqual(txn.txns, test.txns) {
+			t.Errorf("%s: got transactions %v, want %v", test.name, txn.txns, test.txns)
+		}
+		failed := []string{}
+		for _, result := range results {
+			if result.Error != "" {
+				failed = append(failed, result.Key)
+			}
+		}
+		if len(test.failed) == 0 {
+			test.failed = []string{}
+		}
+		if !reflect.DeepEqual(failed, test.failed) {
+			t.Errorf("%s: got failed keys %v, want %v", test.name, failed, test.failed)
+		}
+		if ops := []string{results[0].Op, results[1].Op, results[2].Op}; !reflect.DeepEqual(ops, []string{"create", "update", "delete"}) {
+			t.Errorf("%s: got operations %v", test.name, ops)
+		}
+	}
+}
+
+func TestApplyOpsMarker(t *testing.T) {
+	defer viper.Reset()
+	defer func() { store = nil }()
+	viper.Set("etcd.statedir", "/_git2etcd")
+	commit := testCommit(t, newTestRepo(t), map[string]string{"a": "1"})
+	ops := []storeOp{
+		{Type: opSet, Key: "/p/a", Value: "1"},
+		{Type: opSet, Key: "/p/b", Value: "2"},
+		{Type: opSet, Key: "/p/c", Value: "3"},
+	}
+	for _, txn := range []bool{true, false} {
+		for _, fail := range []string{"", "/p/b"} {
+			mem := newMemStore()
+			mem.fail[fail] = true
+			store = mem
+			if txn {
+				store = &memTxnStore{memStore: mem, max: 2}
+			}
+			repo := &syncedRepo{Name: "r", Prefix: "/p"}
+			err := applyOps(repo, ops, commit)
+			marker, ok, _ := mem.Get("/_git2etcd/r/commit")
+			switch {
+			case fail != "" && err == nil:
+				t.Errorf("txn %v, failing %s: want an error", txn, fail)
+			case fail != "" && ok:
+				t.Errorf("txn %v, failing %s: commit recorded despite the failure", txn, fail)
+			case fail == "" && (err != nil || marker != commit.Hash.String()):
+				t.Errorf("txn %v: got commit %q and error %v", txn, marker, err)
+			case fail == "" && mem.writes[len(mem.writes)-1] != "/_git2etcd/r/commit":
+				t.Errorf("txn %v: commit written before %s", txn, mem.writes[len(mem.writes)-1])
+			}
+			if len(repo.results) != len(ops) {
+				t.Errorf("txn %v, failing %q: got %d results, want %d", txn, fail, len(repo.results), len(ops))
+			}
+		}
+	}
+}
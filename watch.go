@@ -0,0 +1,139 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// ownWriteTTL is how long a write of git2etcd is expected to come back
+// through the watch.
+const ownWriteTTL = time.Minute
+
+type ownWrite struct {
+	op   storeOp
+	time time.Time
+}
+
+var (
+	ownWritesLock sync.Mutex
+	// ownWrites holds the last write of git2etcd to each key by repo, so the
+	// watch of a repo doesn't take them for out-of-band changes
+	ownWrites = map[string]map[string]ownWrite{}
+)
+
+func recordWrites(repo *syncedRepo, ops []storeOp) {
+	ownWritesLock.Lock()
+	defer ownWritesLock.Unlock()
+	if ownWrites[repo.Name] == nil {
+		ownWrites[repo.Name] = map[string]ownWrite{}
+	}
+	now := time.Now()
+	for _, op := range ops {
+		ownWrites[repo.Name][op.Key] = ownWrite{op: op, time: now}
+	}
+}
+
+// isOwnWrite tells whether event is the echo of a recent write of git2etcd
+// for repo.
+func isOwnWrite(repo *syncedRepo, event storeEvent) bool {
+	ownWritesLock.Lock()
+	defer ownWritesLock.Unlock()
+	w, ok := ownWrites[repo.Name][event.Key]
+	if !ok {
+		return false
+	}
+	delete(ownWrites[repo.Name], event.Key)
+	if time.Since(w.time) > ownWriteTTL {
+		return false
+	}
+	if event.Deleted {
+		return w.op.Type == opDelete
+	}
+	return w.op.Type == opSet && w.op.Value == event.Value
+}
+
+// appliedState returns the keys of the applied commit of repo, computed again
+// only when another commit gets applied.
+func appliedState(repo *syncedRepo) (*treeState, error) {
+	if err := recordedState(repo); err != nil {
+		return nil, err
+	}
+	repo.watched.Lock()
+	defer repo.watched.Unlock()
+	tree, hash, err := appliedTree(repo)
+	if err != nil {
+		return nil, err
+	}
+	if repo.watched.state == nil || hash != repo.watched.commit {
+		if repo.watched.state, err = treeKeys(repo, tree); err != nil {
+			return nil, err
+		}
+		repo.watched.commit = hash
+	}
+	return repo.watched.state, nil
+}
+
+// watchLoop watches the managed keys and reverts every change that doesn't
+// match the applied commit, starting again whenever the watch fails.
+func watchLoop(repo *syncedRepo) {
+	ws, ok := store.(WatchStore)
+	if !ok {
+		log.Warn("Store can't be watched, changes won't be reverted")
+		return
+	}
+	log.WithFields(log.Fields{
+		"repo":   repo.Name,
+		"prefix": repo.Prefix,
+	}).Info("Watching managed keys")
+	for {
+		err := ws.Watch(repo.Prefix, func(event storeEvent) {
+			revertEvent(repo, event)
+		})
+		log.WithError(err).Warn("Watch stopped, restarting it")
+		time.Sleep(time.Duration(viper.GetInt("watch.retry")) * time.Second)
+	}
+}
+
+// revertEvent writes back the value of the applied commit when event changed
+// a managed key, or deletes the key it created when pruning.
+func revertEvent(repo *syncedRepo, event storeEvent) {
+	if !underPrefix(event.Key, repo.Prefix) || underPrefix(event.Key, stateDir()) {
+		return
+	}
+	if isOwnWrite(repo, event) || driftPolicy(event.Key) == driftIgnore || !isLeader() {
+		return
+	}
+	// Reverting must not race with a sync writing the next commit
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	state, err := appliedState(repo)
+	if err != nil {
+		log.WithError(err).WithField("key", event.Key).Warn("Couldn't get applied keys, not reverting")
+		return
+	}
+	var op storeOp
+	expected, ok := state.kvs[event.Key]
+	switch {
+	case ok && (event.Deleted || event.Value != expected):
+		op = storeOp{Type: opSet, Key: event.Key, Value: expected}
+	case !ok && !event.Deleted && viper.GetBool("repo.prune"):
+		op = storeOp{Type: opDelete, Key: event.Key}
+	default:
+		return
+	}
+	fields := log.Fields{
+		"repo":     repo.Name,
+		"key":      event.Key,
+		"file":     state.files[event.Key],
+		"revision": event.Revision,
+		"deleted":  event.Deleted,
+	}
+	if err := writeOps(repo, []storeOp{op}); err != nil {
+		log.WithError(err).WithFields(fields).Error("Couldn't revert out-of-band change")
+		return
+	}
+	log.WithFields(fields).Warn("Reverted out-of-band change")
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/google/go-github/github"
+	"github.com/spf13/viper"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// pushEvent is what every provider payload is reduced to before syncing.
+type pushEvent struct {
+	Repo   string
+	Ref    string
+	Before string
+	After  string
+}
+
+func (e pushEvent) deleted() bool {
+	return e.After == "" || plumbing.NewHash(e.After).IsZero()
+}
+
+// webhookProvider knows how to authenticate and read the push webhooks of a
+// git hosting service.
+type webhookProvider interface {
+	verify(r *http.Request, body []byte, secret string) error
+	// parse returns the pushes carried by the request, none for other events
+	parse(r *http.Request, body []byte) ([]pushEvent, error)
+}
+
+var webhookProviders = map[string]webhookProvider{
+	"github":    githubProvider{},
+	"gitlab":    gitlabProvider{},
+	"gitea":     giteaProvider{signatureHeader: "X-Gitea-Signature", eventHeader: "X-Gitea-Event"},
+	"gogs":      giteaProvider{signatureHeader: "X-Gogs-Signature", eventHeader: "X-Gogs-Event"},
+	"bitbucket": bitbucketProvider{},
+}
+
+type webhookConfig struct {
+	Path     string
+	Provider string
+	Secret   string
+	// Repo is the name of the repo the pushes are for
+	Repo string
+	repo *syncedRepo
+}
+
+// webhookConfigs returns the endpoint of each repo followed by the ones listed
+// in host.hooks.
+func webhookConfigs() ([]webhookConfig, error) {
+	extra := []webhookConfig{}
+	if err := viper.UnmarshalKey("host.hooks", &extra); err != nil {
+		return nil, errors.New("Couldn't read host.hooks: " + err.Error())
+	}
+	hooks := []webhookConfig{}
+	for _, repo := range repos {
+		hooks = append(hooks, webhookConfig{Path: repo.Hook, Provider: repo.Provider, Secret: repo.Secret, repo: repo})
+	}
+	for _, hook := range extra {
+		repo, err := findRepo(hook.Repo)
+		if err != nil {
+			return nil, errors.New("Couldn't find the repo of webhook " + hook.Path + ": " + err.Error())
+		}
+		hook.repo = repo
+		if hook.Secret == "" {
+			hook.Secret = repo.Secret
+		}
+		hooks = append(hooks, hook)
+	}
+	paths := map[string]bool{}
+	for _, hook := range hooks {
+		if _, ok := webhookProviders[hook.Provider]; !ok {
+			return nil, errors.New("Unknown webhook provider " + hook.Provider)
+		}
+		if paths[hook.Path] {
+			return nil, errors.New("Duplicate webhook path " + hook.Path)
+		}
+		paths[hook.Path] = true
+	}
+	return hooks, nil
+}
+
+func hookHandler(hook webhookConfig) http.HandlerFunc {
+	provider, repo := webhookProviders[hook.Provider], hook.repo
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.WithError(err).Error("Couldn't read request body")
+			countWebhook(hook, "error")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if hook.Secret != "" {
+			if err := provider.verify(r, body, hook.Secret); err != nil {
+				log.WithError(err).WithField("remote", r.RemoteAddr).Warn("Rejected webhook")
+				countWebhook(hook, "rejected")
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+		}
+		events, err := provider.parse(r, body)
+		if err != nil {
+			log.WithError(err).Error("Couldn't parse webhook payload")
+			countWebhook(hook, "invalid")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(events) == 0 {
+			log.Info("Ignoring webhook without push")
+			countWebhook(hook, "ignored")
+			return
+		}
+		for _, event := range events {
+			if tracksRef(repo, event.Ref) {
+				treatPushEvent(w, hook, event)
+				return
+			}
+			log.WithField("ref", event.Ref).Info("Ignoring push to another ref")
+		}
+		countWebhook(hook, "ignored")
+	}
+}
+
+func countWebhook(hook webhookConfig, outcome string) {
+	addMetric("git2etcd_webhook_deliveries_total", metricLabels("provider", hook.Provider, "outcome", outcome), 1)
+}
+
+func treatPushEvent(w http.ResponseWriter, hook webhookConfig, event pushEvent) {
+	log.Info("Push received from ", event.Repo)
+	if event.deleted() {
+		log.WithField("ref", event.Ref).Warn("Ignoring deletion of the synced ref")
+		countWebhook(hook, "ignored")
+		return
+	}
+	// The pushed commit may already be behind the head, or not be the tag
+	// to sync, so the head of the tracked ref is synced. The provider only
+	// waits a few seconds, the sync is left to the worker.
+	job := enqueueJob(hook.repo, jobAuto, "", "webhook")
+	countWebhook(hook, "queued")
+	writeJobs(w, http.StatusAccepted, job.snapshot())
+}
+
+func verifyHMAC(signature string, body []byte, secret string, h func() hash.Hash) error {
+	if signature == "" {
+		return errors.New("Missing signature")
+	}
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return errors.New("Malformed signature: " + err.Error())
+	}
+	mac := hmac.New(h, []byte(secret))
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return errors.New("Signature mismatch")
+	}
+	return nil
+}
+
+type githubProvider struct{}
+
+func (githubProvider) verify(r *http.Request, body []byte, secret string) error {
+	if signature := r.Header.Get("X-Hub-Signature-256"); signature != "" {
+		return verifyHMAC(strings.TrimPrefix(signature, "sha256="), body, secret, sha256.New)
+	}
+	signature := r.Header.Get("X-Hub-Signature")
+	return verifyHMAC(strings.TrimPrefix(signature, "sha1="), body, secret, sha1.New)
+}
+
+func (githubProvider) parse(r *http.Request, body []byte) ([]pushEvent, error) {
+	if r.Header.Get("X-GitHub-Event") != "push" {
+		return nil, nil
+	}
+	var event github.PushEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, err
+	}
+	return []pushEvent{{
+		Repo:   event.GetRepo().GetFullName(),
+		Ref:    event.GetRef(),
+		Before: event.GetBefore(),
+		After:  event.GetAfter(),
+	}}, nil
+}
+
+type gitlabProvider struct{}
+
+func (gitlabProvider) verify(r *http.Request, body []byte, secret string) error {
+	token := r.Header.Get("X-Gitlab-Token")
+	if token == "" {
+		return errors.New("Missing token")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+		return errors.New("Token mismatch")
+	}
+	return nil
+}
+
+func (gitlabProvider) parse(r *http.Request, body []byte) ([]pushEvent, error) {
+	switch r.Header.Get("X-Gitlab-Event") {
+	case "Push Hook", "Tag Push Hook":
+	default:
+		return nil, nil
+	}
+	var event struct {
+		Ref     string `json:"ref"`
+		Before  string `json:"before"`
+		After   string `json:"after"`
+		Project struct {
+			PathWithNamespace string `json:"path_with_namespace"`
+		} `json:"project"`
+	}
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, err
+	}
+	return []pushEvent{{
+		Repo:   event.Project.PathWithNamespace,
+		Ref:    event.Ref,
+		Before: event.Before,
+		After:  event.After,
+	}}, nil
+}
+
+// giteaProvider handles both Gitea and Gogs, which only differ by their
+// headers.
+type giteaProvider struct {
+	signatureHeader string
+	eventHeader     string
+}
+
+func (p giteaProvider) verify(r *http.Request, body []byte, secret string) error {
+	return verifyHMAC(r.Header.Get(p.signatureHeader), body, secret, sha256.New)
+}
+
+func (p giteaProvider) parse(r *http.Request, body []byte) ([]pushEvent, error) {
+	if r.Header.Get(p.eventHeader) != "push" {
+		return nil, nil
+	}
+	var event struct {
+		Ref        string `json:"ref"`
+		Before     string `json:"before"`
+		After      string `json:"after"`
+		Repository struct {
+			FullName string `json:"full_name"`
+		} `json:"repository"`
+	}
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, err
+	}
+	return []pushEvent{{
+		Repo:   event.Repository.FullName,
+		Ref:    event.Ref,
+		Before: event.Before,
+		After:  event.After,
+	}}, nil
+}
+
+// bitbucketProvider handles Bitbucket Server, which may report several refs
+// in a single push.
+type bitbucketProvider struct{}
+
+func (bitbucketProvider) verify(r *http.Request, body []byte, secret string) error {
+	signature := r.Header.Get("X-Hub-Signature")
+	return verifyHMAC(strings.TrimPrefix(signature, "sha256="), body, secret, sha256.New)
+}
+
+func (bitbucketProvider) parse(r *http.Request, body []byte) ([]pushEvent, error) {
+	if r.Header.Get("X-Event-Key") != "repo:refs_changed" {
+		return nil, nil
+	}
+	var event struct {
+		Repository struct {
+			Slug    string `json:"slug"`
+			Project struct {
+				Key string `json:"key"`
+			} `json:"project"`
+		} `json:"repository"`
+		Changes []struct {
+			RefID    string `json:"refId"`
+			FromHash string `json:"fromHash"`
+			ToHash   string `json:"toHash"`
+		} `json:"changes"`
+	}
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, err
+	}
+	events := []pushEvent{}
+	for _, change := range event.Changes {
+		events = append(events, pushEvent{
+			Repo:   event.Repository.Project.Key + "/" + event.Repository.Slug,
+			Ref:    change.RefID,
+			Before: change.FromHash,
+			After:  change.ToHash,
+		})
+	}
+	return events, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func sign(body []byte, secret string, h func() hash.Hash) string {
+	mac := hmac.New(h, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyHMAC(t *testing.T) {
+	body := []byte(`{"ref":"refs/heads/master"}`)
+	tests := []struct {
+		name      string
+		signature string
+		ok        bool
+	}{
+		{"valid", sign(body, "secret", sha256.New), true},
+		{"other secret", sign(body, "other", sha256.New), false},
+		{"other hash", sign(body, "secret", sha1.New), false},
+		{"malformed", "zz", false},
+		{"missing", "", false},
+	}
+	for _, test := range tests {
+		if err := verifyHMAC(test.signature, body, "secret", sha256.New); (err == nil) != test.ok {
+			t.Errorf("%s: got %v", test.name, err)
+		}
+	}
+}
+
+func TestProviderVerify(t *testing.T) {
+	body := []byte(`{}`)
+	tests := []struct {
+		provider string
+		headers  map[string]string
+		ok       bool
+	}{
+		{"github", map[string]string{"X-Hub-Signature-256": "sha256=" + sign(body, "secret", sha256.New)}, true},
+		{"github", map[string]string{"X-Hub-Signature": "sha1=" + sign(body, "secret", sha1.New)}, true},
+		{"github", map[string]string{"X-Hub-Signature": "sha1=" + sign(body, "other", sha1.New)}, false},
+		{"gitlab", map[string]string{"X-Gitlab-Token": "secret"}, true},
+		{"gitlab", map[string]string{"X-Gitlab-Token": "other"}, false},
+		{"gitlab", map[string]string{}, false},
+		{"gitea", map[string]string{"X-Gitea-Signature": sign(body, "secret", sha256.New)}, true},
+		{"gogs", map[string]string{"X-Gitea-Signature": sign(body, "secret", sha256.New)}, false},
+		{"gogs", map[string]string{"X-Gogs-Signature": sign(body, "secret", sha256.New)}, true},
+		{"bitbucket", map[string]string{"X-Hub-Signature": "sha256=" + sign(body, "secret", sha256.New)}, true},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("POST", "/hook", nil)
+		for key, val := range test.headers {
+			r.Header.Set(key, val)
+		}
+		if err := webhookProviders[test.provider].verify(r, body, "secret"); (err == nil) != test.ok {
+			t.Errorf("%s %v: got %v", test.provider, test.headers, err)
+		}
+	}
+}
+
+func TestProviderParse(t *testing.T) {
+	tests := []struct {
+		provider string
+		header   string
+		event    string
+		body     string
+		want     []pushEvent
+	}{
+		{
+			provider: "github",
+			header:   "X-GitHub-Event",
+			event:    "push",
+			body:     `{"ref": "refs/heads/master", "before": "a", "after": "b", "repository": {"full_name": "yapo/conf"}}`,
+			want:     []pushEvent{{Repo: "yapo/conf", Ref: "refs/heads/master", Before: "a", After: "b"}},
+		},
+		{
+			provider: "github",
+			header:   "X-GitHub-Event",
+			event:    "ping",
+			body:     `{}`,
+		},
+		{
+			provider: "gitlab",
+			header:   "X-Gitlab-Event",
+			event:    "Tag Push Hook",
+			body:     `{"ref": "refs/tags/v1", "before": "a", "after": "b", "project": {"path_with_namespace": "yapo/conf"}}`,
+			want:     []pushEvent{{Repo: "yapo/conf", Ref: "refs/tags/v1", Before: "a", After: "b"}},
+		},
+		{
+			provider: "gitlab",
+			header:   "X-Gitlab-Event",
+			event:    "Merge Request Hook",
+			body:     `{}`,
+		},
+		{
+			provider: "gitea",
+			header:   "X-Gitea-Event",
+			event:    "push",
+			body:     `{"ref": "refs/heads/master", "before": "a", "after": "b", "repository": {"full_name": "yapo/conf"}}`,
+			want:     []pushEvent{{Repo: "yapo/conf", Ref: "refs/heads/master", Before: "a", After: "b"}},
+		},
+		{
+			provider: "gogs",
+			header:   "X-Gogs-Event",
+			event:    "push",
+			body:     `{"ref": "refs/heads/master", "before": "a", "after": "b", "repository": {"full_name": "yapo/conf"}}`,
+			want:     []pushEvent{{Repo: "yapo/conf", Ref: "refs/heads/master", Before: "a", After: "b"}},
+		},
+		{
+			provider: "bitbucket",
+			header:   "X-Event-Key",
+			event:    "repo:refs_changed",
+			body: `{"repository": {"slug": "conf", "project": {"key": "YAPO"}}, "changes": [
+				{"refId": "refs/heads/master", "fromHash": "a", "toHash": "b"},
+				{"refId": "refs/tags/v1", "fromHash": "0", "toHash": "c"}]}`,
+			want: []pushEvent{
+				{Repo: "YAPO/conf", Ref: "refs/heads/master", Before: "a", After: "b"},
+				{Repo: "YAPO/conf", Ref: "refs/tags/v1", Before: "0", After: "c"},
+			},
+		},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("POST", "/hook", nil)
+		r.Header.Set(test.header, test.event)
+		got, err := webhookProviders[test.provider].parse(r, []byte(test.body))
+		if err != nil {
+			t.Errorf("%s %s: %s", test.provider, test.event, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s %s: got %+v, want %+v", test.provider, test.event, got, test.want)
+		}
+	}
+}
+
+func TestProviderParseMalformed(t *testing.T) {
+	for provider, header := range map[string][2]string{
+		"github":    {"X-GitHub-Event", "push"},
+		"gitlab":    {"X-Gitlab-Event", "Push Hook"},
+		"gitea":     {"X-Gitea-Event", "push"},
+		"bitbucket": {"X-Event-Key", "repo:refs_changed"},
+	} {
+		r, _ := http.NewRequest("POST", "/hook", nil)
+		r.Header.Set(header[0], header[1])
+		if _, err := webhookProviders[provider].parse(r, []byte(`{"ref": `)); err == nil {
+			t.Errorf("%s: want an error", provider)
+		}
+	}
+}